@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AccountLabel is an account level label put on a reply author's DID. A row is active until NegatedAt is set, and a
+// later crossing of the threshold starts a new row.
+type AccountLabel struct {
+	gorm.Model
+	Did   string `gorm:"index"`
+	Label string `gorm:"index"`
+	// Count is how many labeled replies were in the window when the row was last checked
+	Count int
+	// ExpiresAt is the exp of the label on the labeler, pushed back by re-emitting the label while the author keeps at it
+	ExpiresAt time.Time
+	NegatedAt *time.Time `gorm:"index"`
+	// NegatedReason says why the label was taken off, either because the author dropped under the threshold or the
+	// label expired
+	NegatedReason string
+}
+
+// AccountLabeler labels the accounts of authors who wrote too many bad faith replies within a sliding window. Counts
+// come from the log db, so bad-faith has to be in LOGGED_LABELS. Labels are emitted and negated through the outbox.
+type AccountLabeler struct {
+	db        *gorm.DB
+	outbox    *Outbox
+	threshold int
+	window    time.Duration
+	ttl       time.Duration
+	// shadow records account labels as shadow labels instead of queueing them
+	shadow bool
+	// shadowOps are the ops in SHADOW_OPS. replies to them never count towards a real account label
+	shadowOps []string
+	logger    *slog.Logger
+
+	// mu keeps Observe and the sweeper from both acting on the same author
+	mu sync.Mutex
+}
+
+func NewAccountLabeler(db *gorm.DB, outbox *Outbox, threshold int, window, ttl time.Duration, shadow bool, shadowOps []string, logger *slog.Logger) (*AccountLabeler, error) {
+	if threshold < 1 {
+		return nil, fmt.Errorf("account label threshold must be at least 1")
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("account label window must be positive")
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("account label ttl must be positive")
+	}
+
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &AccountLabeler{
+		db:        db,
+		outbox:    outbox,
+		threshold: threshold,
+		window:    window,
+		ttl:       ttl,
+		shadow:    shadow,
+		shadowOps: shadowOps,
+		logger:    logger.With("component", "account-labeler"),
+	}, nil
+}
+
+// count is how many of the author's replies were logged as bad faith within the window. Labels a reviewer rejected, or
+// that are still waiting for review, don't count, and neither do replies to shadow ops.
+func (a *AccountLabeler) count(did string) (int, error) {
+	q := a.db.Model(&LogItem{}).
+		Where("author_did = ? AND label = ? AND created_at >= ?", did, LabelBadFaith, time.Now().Add(-a.window)).
+		Where("NOT (reviewed AND NOT confirmed) AND NOT (needs_review AND NOT reviewed)")
+	if len(a.shadowOps) > 0 {
+		q = q.Where("parent_did NOT IN ?", a.shadowOps)
+	}
+
+	var count int64
+	if err := q.
+		Distinct("author_uri").
+		Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("failed to count logged replies: %w", err)
+	}
+	return int(count), nil
+}
+
+func (a *AccountLabeler) active(did string) (*AccountLabel, error) {
+	var rows []AccountLabel
+	if err := a.db.Where("did = ? AND label = ? AND negated_at IS NULL", did, LabelRepeatBadFaith).Limit(1).Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to load account label: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return &rows[0], nil
+}
+
+// Observe recounts the author's recent bad faith replies after a new one was logged, labeling the account when the
+// count reaches the threshold and pushing back the expiry of an existing label. Labels are re-emitted with the later
+// exp once half their ttl has passed, rather than on every reply.
+func (a *AccountLabeler) Observe(did string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	count, err := a.count(did)
+	if err != nil {
+		return err
+	}
+
+	existing, err := a.active(did)
+	if err != nil {
+		return err
+	}
+
+	logger := a.logger.With("did", did, "count", count)
+
+	if existing != nil {
+		existing.Count = count
+		if time.Until(existing.ExpiresAt) > a.ttl/2 {
+			if err := a.db.Save(existing).Error; err != nil {
+				return fmt.Errorf("failed to update account label: %w", err)
+			}
+			return nil
+		}
+
+		existing.ExpiresAt = time.Now().Add(a.ttl)
+		if err := a.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(existing).Error; err != nil {
+				return fmt.Errorf("failed to update account label: %w", err)
+			}
+			if a.shadow {
+				return tx.Create(&ShadowLabel{AuthorDid: did, Uri: did, Label: existing.Label, Backend: "account"}).Error
+			}
+			return enqueueLabel(tx, did, existing.Label, false, &existing.ExpiresAt)
+		}); err != nil {
+			return err
+		}
+		a.outbox.Notify()
+
+		logger.Info("extended account label", "label", existing.Label, "expiresAt", existing.ExpiresAt)
+		return nil
+	}
+
+	if count < a.threshold {
+		return nil
+	}
+
+	row := AccountLabel{
+		Did:       did,
+		Label:     LabelRepeatBadFaith,
+		Count:     count,
+		ExpiresAt: time.Now().Add(a.ttl),
+	}
+	if err := a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&row).Error; err != nil {
+			return fmt.Errorf("failed to insert account label: %w", err)
+		}
+		if a.shadow {
+			return tx.Create(&ShadowLabel{AuthorDid: did, Uri: did, Label: LabelRepeatBadFaith, Backend: "account"}).Error
+		}
+		return enqueueLabel(tx, did, LabelRepeatBadFaith, false, &row.ExpiresAt)
+	}); err != nil {
+		return err
+	}
+	a.outbox.Notify()
+
+	accountLabelChanges.WithLabelValues("emitted").Inc()
+	logger.Info("labeled account", "label", LabelRepeatBadFaith, "expiresAt", row.ExpiresAt)
+
+	return nil
+}
+
+// Run checks active account labels every interval, negating the ones whose author dropped back under the threshold.
+// Labels whose exp passed lapsed on their own, and are only marked as such.
+func (a *AccountLabeler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := a.sweep(); err != nil {
+			a.logger.Error("failed to sweep account labels", "error", err)
+		}
+	}
+}
+
+func (a *AccountLabeler) sweep() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var rows []AccountLabel
+	if err := a.db.Where("negated_at IS NULL").Find(&rows).Error; err != nil {
+		return fmt.Errorf("failed to load account labels: %w", err)
+	}
+
+	negated := false
+	for i := range rows {
+		row := &rows[i]
+
+		count, err := a.count(row.Did)
+		if err != nil {
+			return err
+		}
+		row.Count = count
+
+		var reason string
+		switch {
+		case count < a.threshold:
+			reason = "under threshold"
+		case time.Now().After(row.ExpiresAt):
+			reason = "expired"
+		default:
+			if err := a.db.Save(row).Error; err != nil {
+				return fmt.Errorf("failed to update account label: %w", err)
+			}
+			continue
+		}
+
+		now := time.Now()
+		row.NegatedAt = &now
+		row.NegatedReason = reason
+		if err := a.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(row).Error; err != nil {
+				return fmt.Errorf("failed to update account label: %w", err)
+			}
+			if a.shadow || reason == "expired" {
+				return nil
+			}
+			return enqueueLabel(tx, row.Did, row.Label, true, nil)
+		}); err != nil {
+			return err
+		}
+
+		negated = true
+		accountLabelChanges.WithLabelValues("negated").Inc()
+		a.logger.Info("took label off account", "did", row.Did, "label", row.Label, "count", count, "reason", reason)
+	}
+
+	if negated {
+		a.outbox.Notify()
+	}
+
+	return nil
+}
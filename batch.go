@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GetIsBadFaithBatch classifies several replies to the same parent in a single request. Unlike GetIsBadFaith it makes
+// exactly one attempt, callers are expected to fall back to individual requests when it fails.
+func (c *LMStudioClient) GetIsBadFaithBatch(ctx context.Context, langPrompt, thread, parent string, replies []string, examples []*FewShotExample) ([]*BadFaithResults, error) {
+	var sb strings.Builder
+	for i, r := range replies {
+		fmt.Fprintf(&sb, "Reply %d:\n%s\n\n", i, r)
+	}
+
+	prompt := c.batchPrompt().withInstruction(langPrompt)
+
+	messages := []Message{
+		{
+			Role:    "system",
+			Content: prompt.System,
+		},
+	}
+	messages = append(messages, batchExampleMessages(examples, c.rationale)...)
+	if thread != "" {
+		messages = append(messages, Message{
+			Role:    "user",
+			Content: thread,
+		})
+	}
+	messages = append(messages,
+		Message{
+			Role:    "user",
+			Content: parent,
+		},
+		Message{
+			Role:    "user",
+			Content: sb.String(),
+		},
+	)
+
+	request := c.newRequest(ctx, messages, c.maxTokens(len(replies)+1), "batch_message_classification", prompt.Schema)
+
+	response, err := c.sendChatRequest(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat response: %w", err)
+	}
+
+	result, err := parseStructuredOutput(answerText(response.Choices[0].Message), prompt.Schema)
+	if err != nil {
+		return nil, err
+	}
+	// the thinking covers the whole batch, so every reply gets all of it
+	reasoning := c.currentProfile().reasoning(response.Choices[0].Message)
+
+	items := result["results"].([]any)
+	if len(items) != len(replies) {
+		return nil, &ValidationError{Reason: fmt.Sprintf("expected %d results, got %d", len(replies), len(items))}
+	}
+
+	results := make([]*BadFaithResults, len(replies))
+	for _, item := range items {
+		obj := item.(map[string]any)
+		idx := int(obj["index"].(float64))
+		if idx < 0 || idx >= len(replies) || results[idx] != nil {
+			return nil, &ValidationError{Reason: fmt.Sprintf("result index %d is out of range or repeated", idx)}
+		}
+		results[idx] = resultsFromObject(obj, c.name)
+		results[idx].Reasoning = reasoning
+	}
+
+	return results, nil
+}
+
+// batchExampleMessages shows each example as a batch of one reply, so its answer has the same shape as the real one
+func batchExampleMessages(examples []*FewShotExample, rationale bool) []Message {
+	messages := make([]Message, 0, 2*len(examples))
+	for _, ex := range examples {
+		result := ex.answer(rationale)
+		result["index"] = 0
+		answer, _ := json.Marshal(map[string]any{"results": []any{result}})
+		messages = append(messages,
+			Message{
+				Role:    "user",
+				Content: "[example]\n" + wrapUntrusted("parent", ex.Parent) + "\nReply 0:\n" + wrapUntrusted("reply", ex.Reply),
+			},
+			Message{
+				Role:    "assistant",
+				Content: string(answer),
+			},
+		)
+	}
+	return messages
+}
+
+// BatchingClassifier collects replies to the same parent for a short window and classifies them with one request,
+// so that a viral post doesn't resend the same parent and system prompt for every reply
+type BatchingClassifier struct {
+	client  *LMStudioClient
+	window  time.Duration
+	maxSize int
+	timeout time.Duration
+	logger  *slog.Logger
+
+	mu      sync.Mutex
+	pending map[string]*replyBatch
+}
+
+type replyBatch struct {
+	key        string
+	langPrompt string
+	thread     string
+	parent     string
+	items      []*batchItem
+	timer      *time.Timer
+}
+
+type batchItem struct {
+	input    *ClassificationInput
+	cacheKey string
+	attr     usageAttribution
+	done     chan batchResult
+}
+
+type batchResult struct {
+	results *BadFaithResults
+	err     error
+}
+
+func NewBatchingClassifier(client *LMStudioClient, window time.Duration, maxSize int, logger *slog.Logger) *BatchingClassifier {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	return &BatchingClassifier{
+		client:  client,
+		window:  window,
+		maxSize: maxSize,
+		timeout: 30 * time.Second,
+		logger:  logger.With("component", "batcher", "backend", client.Name()),
+		pending: make(map[string]*replyBatch),
+	}
+}
+
+func (b *BatchingClassifier) Name() string {
+	return b.client.Name()
+}
+
+func (b *BatchingClassifier) GetIsBadFaith(ctx context.Context, input *ClassificationInput) (*BadFaithResults, error) {
+	// the batch prompt is text only, so anything with images goes out on its own
+	if input.HasImages() {
+		return b.client.GetIsBadFaith(ctx, input)
+	}
+
+	cacheKey, results, ok := b.client.cachedResults(ctx, input)
+	if ok {
+		return results, nil
+	}
+
+	thread := renderAncestry(input.Ancestors)
+	parent := input.Parent.Render()
+	// replies in different languages need different prompts, so they can't share a batch
+	key := input.LangPrompt + "\x00" + thread + "\x00" + parent
+
+	item := &batchItem{
+		input:    input,
+		cacheKey: cacheKey,
+		attr:     usageAttributionFrom(ctx),
+		done:     make(chan batchResult, 1),
+	}
+
+	b.mu.Lock()
+	batch, ok := b.pending[key]
+	if !ok {
+		batch = &replyBatch{key: key, langPrompt: input.LangPrompt, thread: thread, parent: parent}
+		b.pending[key] = batch
+		batch.timer = time.AfterFunc(b.window, func() {
+			b.flush(batch)
+		})
+	}
+	batch.items = append(batch.items, item)
+	full := len(batch.items) >= b.maxSize
+	if full {
+		delete(b.pending, key)
+		batch.timer.Stop()
+	}
+	b.mu.Unlock()
+
+	if full {
+		go b.run(batch)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-item.done:
+		return res.results, res.err
+	}
+}
+
+func (b *BatchingClassifier) flush(batch *replyBatch) {
+	b.mu.Lock()
+	// the batch may have already filled up and been sent
+	if b.pending[batch.key] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, batch.key)
+	b.mu.Unlock()
+
+	b.run(batch)
+}
+
+func (b *BatchingClassifier) run(batch *replyBatch) {
+	if len(batch.items) == 1 {
+		b.runIndividually(batch)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+
+	// every reply in the batch shares a parent, and so an op. a batched request can't be tied to a single reply though
+	ctx = withUsageAttribution(ctx, batch.items[0].attr.OpDid, "")
+
+	replies := make([]string, len(batch.items))
+	for i, item := range batch.items {
+		replies[i] = wrapUntrusted("reply", item.input.Reply.Render())
+		if replier := item.input.Replier.Render(); replier != "" {
+			replies[i] += "\n\n" + replier
+		}
+	}
+
+	// examples are picked for the first reply, the batch can only show one set
+	examples := b.client.examples.Select(ctx, batch.items[0].input, b.client.rationale)
+
+	results, err := b.client.GetIsBadFaithBatch(ctx, batch.langPrompt, batch.thread, wrapUntrusted("parent", batch.parent), replies, examples)
+	if err != nil {
+		b.logger.Warn("batch classification failed, falling back to individual requests", "size", len(batch.items), "error", err)
+		b.runIndividually(batch)
+		return
+	}
+
+	b.logger.Info("classified batch", "size", len(batch.items))
+
+	for i, item := range batch.items {
+		b.client.storeResults(ctx, item.cacheKey, results[i])
+		item.done <- batchResult{results: results[i]}
+	}
+}
+
+// runIndividually classifies each reply with its own request. Each gets a fresh timeout, since a batch that failed
+// may have used up most of its own.
+func (b *BatchingClassifier) runIndividually(batch *replyBatch) {
+	var wg sync.WaitGroup
+	for _, item := range batch.items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+			defer cancel()
+			ctx = withUsageAttribution(ctx, item.attr.OpDid, item.attr.Uri)
+			results, err := b.client.GetIsBadFaith(ctx, item.input)
+			item.done <- batchResult{results: results, err: err}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CachedClassification is a previous result for an identical parent/reply pair. The key already covers the model and
+// prompt, so a row is never reused for a different prompt or model.
+type CachedClassification struct {
+	CacheKey        string `gorm:"primaryKey"`
+	Model           string
+	BadFaith        bool
+	OffTopic        bool
+	Funny           bool
+	PromptInjection bool
+	Rationale       string
+	CreatedAt       time.Time
+	ExpiresAt       time.Time `gorm:"index"`
+}
+
+type ClassificationCache struct {
+	db     *gorm.DB
+	ttl    time.Duration
+	logger *slog.Logger
+}
+
+func NewClassificationCache(db *gorm.DB, ttl time.Duration, logger *slog.Logger) *ClassificationCache {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &ClassificationCache{
+		db:     db,
+		ttl:    ttl,
+		logger: logger.With("component", "cache"),
+	}
+}
+
+// classificationCacheKey hashes every input that can change the result. Each part is length prefixed so that moving
+// text between the parent and the reply can't produce the same key.
+func classificationCacheKey(parts ...string) string {
+	h := sha256.New()
+	var l [8]byte
+	for _, p := range parts {
+		binary.BigEndian.PutUint64(l[:], uint64(len(p)))
+		h.Write(l[:])
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (cc *ClassificationCache) Get(ctx context.Context, key string) (*BadFaithResults, bool) {
+	var row CachedClassification
+	err := cc.db.WithContext(ctx).Where("cache_key = ? AND expires_at > ?", key, time.Now()).Limit(1).Find(&row).Error
+	if err != nil {
+		cc.logger.Error("failed to read classification cache", "error", err)
+		return nil, false
+	}
+
+	if row.CacheKey == "" {
+		return nil, false
+	}
+
+	return &BadFaithResults{
+		BadFaith:        row.BadFaith,
+		OffTopic:        row.OffTopic,
+		Funny:           row.Funny,
+		PromptInjection: row.PromptInjection,
+		Rationale:       row.Rationale,
+	}, true
+}
+
+func (cc *ClassificationCache) Put(ctx context.Context, key, model string, results *BadFaithResults) {
+	now := time.Now()
+	row := CachedClassification{
+		CacheKey:        key,
+		Model:           model,
+		BadFaith:        results.BadFaith,
+		OffTopic:        results.OffTopic,
+		Funny:           results.Funny,
+		PromptInjection: results.PromptInjection,
+		Rationale:       results.Rationale,
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(cc.ttl),
+	}
+
+	if err := cc.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error; err != nil {
+		cc.logger.Error("failed to write classification cache", "error", err)
+	}
+}
+
+// Sweep periodically deletes expired rows so the table doesn't grow forever
+func (cc *ClassificationCache) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		res := cc.db.WithContext(ctx).Where("expires_at <= ?", time.Now()).Delete(&CachedClassification{})
+		if res.Error != nil {
+			cc.logger.Error("failed to sweep classification cache", "error", res.Error)
+		} else if res.RowsAffected > 0 {
+			cc.logger.Info("swept expired classifications", "count", res.RowsAffected)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
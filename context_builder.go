@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// most mentions to resolve to handles for a single post. the total count is always included
+const maxResolvedMentions = 10
+
+// LinkCard is a link attached to or mentioned in a post
+type LinkCard struct {
+	Domain      string
+	Title       string
+	Description string
+}
+
+// buildPostContent collects the text of a post along with the context the model needs to make sense of it: link
+// cards, image alt text, mentions and hashtags. Images themselves are fetched separately.
+func (dsmt *DontShowMeThis) buildPostContent(ctx context.Context, post *bsky.FeedPost) PostContent {
+	content := PostContent{Text: post.Text}
+
+	var external *bsky.EmbedExternal
+	if post.Embed != nil {
+		if post.Embed.EmbedExternal != nil {
+			external = post.Embed.EmbedExternal
+		} else if post.Embed.EmbedRecordWithMedia != nil && post.Embed.EmbedRecordWithMedia.Media != nil {
+			external = post.Embed.EmbedRecordWithMedia.Media.EmbedExternal
+		}
+	}
+	if external != nil && external.External != nil {
+		content.Links = append(content.Links, LinkCard{
+			Domain:      linkDomain(external.External.Uri),
+			Title:       external.External.Title,
+			Description: external.External.Description,
+		})
+	}
+
+	for _, img := range postImages(post) {
+		if img.Alt != "" {
+			content.AltTexts = append(content.AltTexts, img.Alt)
+		}
+	}
+
+	var mentionDids []string
+	for _, facet := range post.Facets {
+		for _, feature := range facet.Features {
+			switch {
+			case feature.RichtextFacet_Mention != nil:
+				if !slices.Contains(mentionDids, feature.RichtextFacet_Mention.Did) {
+					mentionDids = append(mentionDids, feature.RichtextFacet_Mention.Did)
+				}
+			case feature.RichtextFacet_Link != nil:
+				domain := linkDomain(feature.RichtextFacet_Link.Uri)
+				if !slices.ContainsFunc(content.Links, func(l LinkCard) bool { return l.Domain == domain }) {
+					content.Links = append(content.Links, LinkCard{Domain: domain})
+				}
+			case feature.RichtextFacet_Tag != nil:
+				if !slices.Contains(content.Tags, feature.RichtextFacet_Tag.Tag) {
+					content.Tags = append(content.Tags, feature.RichtextFacet_Tag.Tag)
+				}
+			}
+		}
+	}
+
+	for _, tag := range post.Tags {
+		if !slices.Contains(content.Tags, tag) {
+			content.Tags = append(content.Tags, tag)
+		}
+	}
+
+	content.MentionCount = len(mentionDids)
+	for _, did := range mentionDids[:min(len(mentionDids), maxResolvedMentions)] {
+		content.Mentions = append(content.Mentions, dsmt.resolveHandle(ctx, did))
+	}
+
+	return content
+}
+
+// resolveHandle returns the handle for a did, falling back to the did itself if it can't be resolved
+func (dsmt *DontShowMeThis) resolveHandle(ctx context.Context, did string) string {
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return did
+	}
+
+	ident, err := dsmt.directory.LookupDID(ctx, parsed)
+	if err != nil || ident.Handle.String() == "" || ident.Handle.String() == "handle.invalid" {
+		return did
+	}
+
+	return "@" + ident.Handle.String()
+}
+
+func linkDomain(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.Hostname() == "" {
+		return link
+	}
+	return strings.TrimPrefix(u.Hostname(), "www.")
+}
+
+// Render formats the post for the prompt. Anything beyond the text goes into a clearly marked context section after it.
+func (p *PostContent) Render() string {
+	if p.OriginalText == "" && len(p.Links) == 0 && len(p.AltTexts) == 0 && p.MentionCount == 0 && len(p.Tags) == 0 {
+		return p.Text
+	}
+
+	var sb strings.Builder
+	sb.WriteString(p.Text)
+	sb.WriteString("\n\n[post context]\n")
+
+	if p.OriginalText != "" {
+		fmt.Fprintf(&sb, "- machine translated, the original text is %q\n", p.OriginalText)
+	}
+
+	for _, l := range p.Links {
+		fmt.Fprintf(&sb, "- links to %s", l.Domain)
+		if l.Title != "" {
+			fmt.Fprintf(&sb, ", titled %q", l.Title)
+		}
+		if l.Description != "" {
+			fmt.Fprintf(&sb, ", described as %q", l.Description)
+		}
+		sb.WriteString("\n")
+	}
+
+	for _, alt := range p.AltTexts {
+		fmt.Fprintf(&sb, "- has an image with the alt text %q\n", alt)
+	}
+
+	if p.MentionCount > 0 {
+		fmt.Fprintf(&sb, "- mentions %d accounts: %s", p.MentionCount, strings.Join(p.Mentions, ", "))
+		if p.MentionCount > len(p.Mentions) {
+			fmt.Fprintf(&sb, " and %d more", p.MentionCount-len(p.Mentions))
+		}
+		sb.WriteString("\n")
+	}
+
+	if len(p.Tags) > 0 {
+		fmt.Fprintf(&sb, "- hashtags: #%s\n", strings.Join(p.Tags, ", #"))
+	}
+
+	return sb.String()
+}
+
+// Original is the text as the author wrote it, before any translation
+func (p *PostContent) Original() string {
+	if p.OriginalText != "" {
+		return p.OriginalText
+	}
+	return p.Text
+}
+
+// Empty reports whether there is nothing at all to classify
+func (p *PostContent) Empty() bool {
+	return p.Text == "" && len(p.Images) == 0 && len(p.Links) == 0 && len(p.AltTexts) == 0
+}
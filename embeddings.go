@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/pkg/robusthttp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	BackendKindCompletions = "completions"
+	BackendKindEmbeddings  = "embeddings"
+)
+
+// how many texts to send in a single embeddings request while indexing
+const embeddingsIndexBatchSize = 32
+
+// ReplyEmbedding is the embedding of a logged parent/reply pair, along with the labels the reply was logged with. An
+// empty Labels means the reply was logged with no labels. Labels a reviewer rejected, or that are waiting for review,
+// are left out.
+type ReplyEmbedding struct {
+	ID        uint   `gorm:"primaryKey"`
+	Model     string `gorm:"uniqueIndex:idx_reply_embeddings_model_uri"`
+	AuthorUri string `gorm:"uniqueIndex:idx_reply_embeddings_model_uri"`
+	Labels    string
+	Vector    []byte
+	// LogUpdatedAt and LastLogItemID are the sync cursor when the row was stored
+	LogUpdatedAt  time.Time
+	LastLogItemID uint `gorm:"index"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+type EmbeddingsRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type EmbeddingsResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+type indexedReply struct {
+	authorUri string
+	labels    []string
+	vector    []float32
+}
+
+// EmbeddingClassifier labels a reply by the labels of the most similar replies already in the log database. It is
+// much cheaper than asking a completions model, and abstains when it hasn't seen anything similar enough.
+type EmbeddingClassifier struct {
+	name             string
+	host             string
+	endpointOverride string
+	apiKey           string
+	apiKeyType       string
+	modelName        string
+	httpc            *http.Client
+	limiter          *RateLimiter
+	usage            *UsageTracker
+	db               *gorm.DB
+	logger           *slog.Logger
+
+	k              int
+	minSimilarity  float64
+	labelThreshold float64
+
+	mu    sync.RWMutex
+	index []*indexedReply
+	byUri map[string]*indexedReply
+	// the updated_at and id of the last log row synced
+	cursorTime time.Time
+	cursorID   uint
+}
+
+func NewEmbeddingClassifier(config BackendConfig, db *gorm.DB, usage *UsageTracker, logger *slog.Logger) (*EmbeddingClassifier, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	name := config.Name
+	if name == "" {
+		name = config.Model
+	}
+
+	k := config.K
+	if k <= 0 {
+		k = 5
+	}
+	labelThreshold := config.LabelThreshold
+	if labelThreshold <= 0 {
+		labelThreshold = 0.5
+	}
+
+	e := &EmbeddingClassifier{
+		name:             name,
+		host:             config.Host,
+		endpointOverride: config.EndpointOverride,
+		apiKey:           config.ApiKey,
+		apiKeyType:       config.ApiKeyType,
+		modelName:        config.Model,
+		httpc:            robusthttp.NewClient(),
+		limiter:          NewRateLimiter(name, config.RequestsPerMinute, config.TokensPerMinute, config.MaxInFlight),
+		usage:            usage,
+		db:               db,
+		logger:           logger.With("component", "embeddings", "backend", name),
+		k:                k,
+		minSimilarity:    config.MinSimilarity,
+		labelThreshold:   labelThreshold,
+		byUri:            make(map[string]*indexedReply),
+	}
+
+	var rows []ReplyEmbedding
+	if err := db.Where("model = ?", config.Model).Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to load embeddings: %w", err)
+	}
+	for _, row := range rows {
+		e.addLocked(row)
+	}
+
+	e.logger.Info("loaded embedding index", "size", len(e.index), "cursor", e.cursorTime)
+
+	return e, nil
+}
+
+func (e *EmbeddingClassifier) Name() string {
+	return e.name
+}
+
+func (e *EmbeddingClassifier) GetIsBadFaith(ctx context.Context, input *ClassificationInput) (*BadFaithResults, error) {
+	// the index is built from the log db, which keeps the untranslated text
+	vectors, err := e.embed(ctx, []string{pairText(input.Parent.Original(), input.Reply.Original())})
+	if err != nil {
+		return nil, err
+	}
+	query := vectors[0]
+
+	// never count the reply itself if it has been logged before
+	self := usageAttributionFrom(ctx).Uri
+
+	type neighbor struct {
+		reply      *indexedReply
+		similarity float64
+	}
+
+	e.mu.RLock()
+	neighbors := make([]neighbor, 0, e.k+1)
+	for _, r := range e.index {
+		if r.authorUri == self || len(r.vector) != len(query) {
+			continue
+		}
+		sim := dot(query, r.vector)
+		if sim < e.minSimilarity {
+			continue
+		}
+		if len(neighbors) == e.k && sim <= neighbors[len(neighbors)-1].similarity {
+			continue
+		}
+		i, _ := slices.BinarySearchFunc(neighbors, sim, func(n neighbor, s float64) int {
+			// sorted by similarity, highest first
+			switch {
+			case n.similarity > s:
+				return -1
+			case n.similarity < s:
+				return 1
+			}
+			return 0
+		})
+		neighbors = slices.Insert(neighbors, i, neighbor{reply: r, similarity: sim})
+		if len(neighbors) > e.k {
+			neighbors = neighbors[:e.k]
+		}
+	}
+	e.mu.RUnlock()
+
+	if len(neighbors) < e.k {
+		return nil, permanentError(fmt.Errorf("only %d labeled examples are similar enough, need %d", len(neighbors), e.k))
+	}
+
+	var total float64
+	weights := make(map[string]float64, len(AllLabels))
+	for _, n := range neighbors {
+		total += n.similarity
+		for _, l := range n.reply.labels {
+			weights[l] += n.similarity
+		}
+	}
+
+	results := &BadFaithResults{Backend: e.name}
+	if total > 0 {
+		for _, l := range AllLabels {
+			results.Set(l, weights[l]/total >= e.labelThreshold)
+		}
+	}
+
+	return results, nil
+}
+
+// Sync embeds replies as they are logged, so the index grows with the log database
+func (e *EmbeddingClassifier) Sync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := e.syncOnce(ctx)
+			if err != nil {
+				e.logger.Error("failed to sync embedding index", "error", err)
+				break
+			}
+			if n == 0 {
+				break
+			}
+			e.logger.Info("indexed logged replies", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncOnce reindexes the replies of the next chunk of log rows changed since the cursor, and returns how many rows it
+// read. Rows are picked up again whenever they are updated, so a review or a negation after a reply was indexed changes
+// its labels, or takes it out of the index, on the next sync.
+func (e *EmbeddingClassifier) syncOnce(ctx context.Context) (int, error) {
+	e.mu.RLock()
+	cursorTime, cursorID := e.cursorTime, e.cursorID
+	e.mu.RUnlock()
+
+	var items []LogItem
+	if err := e.db.WithContext(ctx).
+		Where("updated_at > ? OR (updated_at = ? AND id > ?)", cursorTime, cursorTime, cursorID).
+		Where("label != ?", LabelUnclassified).
+		Order("updated_at, id").
+		Limit(embeddingsIndexBatchSize).
+		Find(&items).Error; err != nil {
+		return 0, fmt.Errorf("failed to load log items: %w", err)
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+	last := items[len(items)-1]
+
+	var order []string
+	seen := make(map[string]bool)
+	for _, item := range items {
+		if !seen[item.AuthorUri] {
+			seen[item.AuthorUri] = true
+			order = append(order, item.AuthorUri)
+		}
+	}
+
+	// a reply is logged once for each of its labels, and only some of them may have changed, so every row of the
+	// reply is looked at again
+	var rows []LogItem
+	if err := e.db.WithContext(ctx).
+		Where("author_uri IN ? AND label != ?", order, LabelUnclassified).
+		Order("id").
+		Find(&rows).Error; err != nil {
+		return 0, fmt.Errorf("failed to load log items: %w", err)
+	}
+
+	pending := make(map[string]*ReplyEmbedding)
+	texts := make(map[string]string)
+	for _, item := range rows {
+		// disagreements nobody has looked at yet, and labels a reviewer rejected, aren't trustworthy examples
+		if item.AuthorText == "" || item.NeedsReview && !item.Reviewed || item.Reviewed && !item.Confirmed {
+			continue
+		}
+
+		row, ok := pending[item.AuthorUri]
+		if !ok {
+			row = &ReplyEmbedding{Model: e.modelName, AuthorUri: item.AuthorUri, LastLogItemID: last.ID, LogUpdatedAt: last.UpdatedAt}
+			e.mu.RLock()
+			existing := e.byUri[item.AuthorUri]
+			e.mu.RUnlock()
+			if existing != nil {
+				row.Vector = encodeVector(existing.vector)
+			} else {
+				texts[item.AuthorUri] = pairText(item.ParentText, item.AuthorText)
+			}
+			pending[item.AuthorUri] = row
+		}
+
+		if item.Label != LabelNoLabels {
+			labels := splitLabels(row.Labels)
+			if !slices.Contains(labels, item.Label) {
+				row.Labels = strings.Join(append(labels, item.Label), ",")
+			}
+		}
+	}
+
+	// replies left without a single usable row are taken out of the index
+	var removed []string
+	for _, uri := range order {
+		if _, ok := pending[uri]; !ok {
+			removed = append(removed, uri)
+		}
+	}
+
+	if len(texts) > 0 {
+		uris := make([]string, 0, len(texts))
+		inputs := make([]string, 0, len(texts))
+		for _, uri := range order {
+			if t, ok := texts[uri]; ok {
+				uris = append(uris, uri)
+				inputs = append(inputs, t)
+			}
+		}
+
+		vectors, err := e.embed(ctx, inputs)
+		if err != nil {
+			return 0, err
+		}
+		for i, uri := range uris {
+			pending[uri].Vector = encodeVector(vectors[i])
+		}
+	}
+
+	if len(pending) > 0 {
+		stored := make([]ReplyEmbedding, 0, len(pending))
+		for _, uri := range order {
+			if row, ok := pending[uri]; ok {
+				stored = append(stored, *row)
+			}
+		}
+		if err := e.db.WithContext(ctx).Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "model"}, {Name: "author_uri"}},
+			DoUpdates: clause.AssignmentColumns([]string{"labels", "vector", "last_log_item_id", "log_updated_at", "updated_at"}),
+		}).Create(&stored).Error; err != nil {
+			return 0, fmt.Errorf("failed to store embeddings: %w", err)
+		}
+	}
+
+	if len(removed) > 0 {
+		if err := e.db.WithContext(ctx).Where("model = ? AND author_uri IN ?", e.modelName, removed).Delete(&ReplyEmbedding{}).Error; err != nil {
+			return 0, fmt.Errorf("failed to remove embeddings: %w", err)
+		}
+	}
+
+	e.mu.Lock()
+	for _, uri := range order {
+		if row, ok := pending[uri]; ok {
+			e.addLocked(*row)
+		}
+	}
+	if len(removed) > 0 {
+		e.removeLocked(removed)
+	}
+	e.advanceLocked(last.UpdatedAt, last.ID)
+	e.mu.Unlock()
+
+	return len(items), nil
+}
+
+func (e *EmbeddingClassifier) addLocked(row ReplyEmbedding) {
+	r, ok := e.byUri[row.AuthorUri]
+	if !ok {
+		r = &indexedReply{authorUri: row.AuthorUri}
+		e.byUri[row.AuthorUri] = r
+		e.index = append(e.index, r)
+	}
+	r.labels = splitLabels(row.Labels)
+	r.vector = decodeVector(row.Vector)
+	e.advanceLocked(row.LogUpdatedAt, row.LastLogItemID)
+}
+
+func (e *EmbeddingClassifier) removeLocked(uris []string) {
+	for _, uri := range uris {
+		delete(e.byUri, uri)
+	}
+	e.index = slices.DeleteFunc(e.index, func(r *indexedReply) bool { return slices.Contains(uris, r.authorUri) })
+}
+
+// advanceLocked moves the cursor forward to the log row updated at the given time, never back
+func (e *EmbeddingClassifier) advanceLocked(updatedAt time.Time, id uint) {
+	if updatedAt.After(e.cursorTime) || updatedAt.Equal(e.cursorTime) && id > e.cursorID {
+		e.cursorTime, e.cursorID = updatedAt, id
+	}
+}
+
+func (e *EmbeddingClassifier) embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	endpoint := "/v1/embeddings"
+	if e.endpointOverride != "" {
+		endpoint = e.endpointOverride
+	}
+
+	b, err := json.Marshal(EmbeddingsRequest{Model: e.modelName, Input: inputs})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	release, err := e.limiter.Acquire(ctx, len(b)/4)
+	if err != nil {
+		return nil, permanentError(fmt.Errorf("gave up waiting for rate limiter: %w", err))
+	}
+	var usedTokens int
+	defer func() {
+		release(usedTokens)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.host+endpoint, bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("accept", "application/json")
+	setApiKey(req, e.apiKey, e.apiKeyType)
+
+	resp, err := e.httpc.Do(req)
+	if err != nil {
+		return nil, retryableError(fmt.Errorf("error sending request: %w", err))
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, retryableError(fmt.Errorf("error reading response: %w", err))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("bad status code: %d - %s", resp.StatusCode, string(body))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			if retryAfter := parseRetryAfter(resp.Header); retryAfter > 0 {
+				e.limiter.Pause(retryAfter)
+			}
+			return nil, retryableError(err)
+		}
+		if resp.StatusCode >= 500 {
+			return nil, retryableError(err)
+		}
+		return nil, permanentError(err)
+	}
+
+	var embResp EmbeddingsResponse
+	if err := json.Unmarshal(body, &embResp); err != nil {
+		return nil, retryableError(fmt.Errorf("error unmarshaling response: %w", err))
+	}
+
+	if embResp.Usage != nil {
+		usedTokens = embResp.Usage.Total()
+		if e.usage != nil {
+			e.usage.Record(ctx, e.name, e.modelName, embResp.Usage)
+		}
+	}
+
+	if len(embResp.Data) != len(inputs) {
+		return nil, retryableError(fmt.Errorf("expected %d embeddings, got %d", len(inputs), len(embResp.Data)))
+	}
+
+	vectors := make([][]float32, len(inputs))
+	for _, d := range embResp.Data {
+		if d.Index < 0 || d.Index >= len(inputs) || vectors[d.Index] != nil {
+			return nil, permanentError(fmt.Errorf("embedding index %d is out of range or repeated", d.Index))
+		}
+		vectors[d.Index] = normalize(d.Embedding)
+	}
+
+	return vectors, nil
+}
+
+// pairText is what gets embedded. the reply alone loses too much, a short "yes" means nothing without its parent
+func pairText(parent, reply string) string {
+	return "Post: " + parent + "\nReply: " + reply
+}
+
+func splitLabels(labels string) []string {
+	if labels == "" {
+		return nil
+	}
+	return strings.Split(labels, ",")
+}
+
+// normalize scales a vector to unit length, so that cosine similarity is a plain dot product
+func normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(math.Sqrt(sum))
+	out := make([]float32, len(v))
+	for i, x := range v {
+		out[i] = x / norm
+	}
+	return out
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+func encodeVector(v []float32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(x))
+	}
+	return b
+}
+
+func decodeVector(b []byte) []float32 {
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v
+}
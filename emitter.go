@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	// labels are posted to the skyware labeler in labeler/
+	LabelerModeRemote = "remote"
+	// labels are signed and served by the labeler built into this process
+	LabelerModeLocal = "local"
+)
+
+// LabelEmitter puts labels on posts, and takes them off again. Labels emitted with an exp lapse on their own at that time
+type LabelEmitter interface {
+	Emit(ctx context.Context, uri, label string, exp *time.Time) error
+	Negate(ctx context.Context, uri, label string) error
+}
+
+// openEmitter creates the emitter for the configured labeler mode. Subcommands share the root command's flags, so
+// they can use it too. The local labeler isn't started, only the consumer serves it.
+func openEmitter(cmd *cli.Context, db *gorm.DB, httpc *http.Client, logger *slog.Logger) (LabelEmitter, error) {
+	switch cmd.String("labeler-mode") {
+	case LabelerModeRemote:
+		url, key := cmd.String("labeler-url"), cmd.String("labeler-key")
+		if url == "" || key == "" {
+			return nil, fmt.Errorf("remote labeler mode needs a labeler url and key")
+		}
+		return NewRemoteEmitter(url, key, httpc), nil
+	case LabelerModeLocal:
+		if db == nil {
+			return nil, fmt.Errorf("local labeler mode stores labels in the log db, but no db name was included in arguments")
+		}
+		did, signingKey := cmd.String("labeler-did"), cmd.String("labeler-signing-key")
+		if did == "" || signingKey == "" {
+			return nil, fmt.Errorf("local labeler mode needs a labeler did and signing key")
+		}
+		key, err := ParseSigningKey(signingKey)
+		if err != nil {
+			return nil, err
+		}
+		labeler, err := NewLabeler(db, did, key, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create labeler: %w", err)
+		}
+		return labeler, nil
+	}
+	return nil, fmt.Errorf("bad labeler mode. must be either \"remote\" or \"local\"")
+}
+
+type EmitLabelRequest struct {
+	Uri   string `json:"uri"`
+	Label string `json:"label"`
+	// Neg takes the label off the post instead of adding it
+	Neg bool `json:"neg,omitempty"`
+	// Exp is when the label expires, empty for labels that don't
+	Exp string `json:"exp,omitempty"`
+}
+
+// RemoteEmitter sends labels to the /emit endpoint of the skyware labeler
+type RemoteEmitter struct {
+	url   string
+	key   string
+	httpc *http.Client
+}
+
+func NewRemoteEmitter(url, key string, httpc *http.Client) *RemoteEmitter {
+	return &RemoteEmitter{
+		url:   url,
+		key:   key,
+		httpc: httpc,
+	}
+}
+
+func (e *RemoteEmitter) Emit(ctx context.Context, uri, label string, exp *time.Time) error {
+	req := &EmitLabelRequest{
+		Uri:   uri,
+		Label: label,
+	}
+	if exp != nil {
+		req.Exp = exp.UTC().Format(atprotoTime)
+	}
+	return e.send(ctx, req)
+}
+
+func (e *RemoteEmitter) Negate(ctx context.Context, uri, label string) error {
+	return e.send(ctx, &EmitLabelRequest{
+		Uri:   uri,
+		Label: label,
+		Neg:   true,
+	})
+}
+
+func (e *RemoteEmitter) send(ctx context.Context, body *EmitLabelRequest) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url+"/emit", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("authorization", "Bearer "+e.key)
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := e.httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received invalid status code from server: %d", resp.StatusCode)
+	}
+
+	return nil
+}
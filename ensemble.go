@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Classifier is implemented by anything that can decide which labels apply to a reply.
+type Classifier interface {
+	Name() string
+	GetIsBadFaith(ctx context.Context, input *ClassificationInput) (*BadFaithResults, error)
+}
+
+// PostContent is everything about a post that gets shown to the classifiers
+type PostContent struct {
+	Text string
+	// OriginalText is what the author wrote, when Text is a translation of it
+	OriginalText string
+	Images       []ImageInput
+
+	Links        []LinkCard
+	AltTexts     []string
+	Mentions     []string
+	MentionCount int
+	Tags         []string
+}
+
+// key identifies the content for caching. Images are only part of it for backends that actually look at them.
+func (p *PostContent) key(withImages bool) string {
+	if !withImages || len(p.Images) == 0 {
+		return p.Render()
+	}
+	var sb strings.Builder
+	sb.WriteString(p.Render())
+	for _, img := range p.Images {
+		sb.WriteString("\x00")
+		sb.WriteString(img.Hash())
+	}
+	return sb.String()
+}
+
+type ClassificationInput struct {
+	// Ancestors are the posts above the parent in the thread, oldest first
+	Ancestors []ThreadEntry
+	Parent    PostContent
+	Reply     PostContent
+	// Replier is what we know about the author of the reply, nil unless replier context is enabled
+	Replier *ReplierContext
+	// Lang is the language the reply was written in, and LangPrompt the extra instruction for classifying it
+	Lang       string
+	LangPrompt string
+}
+
+func (in *ClassificationInput) HasImages() bool {
+	return len(in.Parent.Images) > 0 || len(in.Reply.Images) > 0
+}
+
+type EnsemblePolicy string
+
+const (
+	// every successful vote must agree before a label is emitted. splits go to review
+	PolicyUnanimous EnsemblePolicy = "unanimous"
+	// more than half of the successful votes must agree. ties and losing minorities go to review
+	PolicyMajority EnsemblePolicy = "majority"
+	// the weighted share of yes votes must reach the weight threshold. anything short of it with at least one yes goes to review
+	PolicyWeighted EnsemblePolicy = "weighted"
+	// any yes vote logs the label, every vote must agree to emit it
+	PolicyAnyLogAllEmit EnsemblePolicy = "any-log-all-emit"
+)
+
+type EnsembleMember struct {
+	Classifier Classifier
+	Weight     float64
+	// FirstPass members are asked on their own first. the rest are only asked if every first pass member abstains
+	FirstPass bool
+}
+
+type Ensemble struct {
+	members         []EnsembleMember
+	policy          EnsemblePolicy
+	weightThreshold float64
+	// minVotes is how many successful votes a label needs to be emitted, 0 for more than half of the members asked
+	minVotes int
+	logger   *slog.Logger
+}
+
+type Vote struct {
+	Backend string
+	Weight  float64
+	Results *BadFaithResults
+	Err     error
+}
+
+// Decision is the combined outcome of an ensemble run. Labels in Emit are safe to publish, labels in Log should only be
+// written to the log db, and labels in Review were disputed by the backends and need a human to look at them.
+type Decision struct {
+	Emit   []string
+	Log    []string
+	Review []string
+	Votes  []*Vote
+	// Backends are the backends whose votes the decision was made from
+	Backends []string
+}
+
+func (d *Decision) Empty() bool {
+	return len(d.Emit) == 0 && len(d.Log) == 0 && len(d.Review) == 0
+}
+
+// Rationale joins the rationales of the votes the decision was made from. with a single vote it is just that vote's
+func (d *Decision) Rationale() string {
+	return d.joinVotes(func(r *BadFaithResults) string { return r.Rationale })
+}
+
+// Reasoning joins the thinking of reasoning models behind the decision
+func (d *Decision) Reasoning() string {
+	return d.joinVotes(func(r *BadFaithResults) string { return r.Reasoning })
+}
+
+func (d *Decision) joinVotes(field func(*BadFaithResults) string) string {
+	var voted []*Vote
+	for _, v := range d.Votes {
+		if v.Err == nil && v.Results != nil && field(v.Results) != "" {
+			voted = append(voted, v)
+		}
+	}
+	if len(voted) == 1 {
+		return field(voted[0].Results)
+	}
+
+	parts := make([]string, len(voted))
+	for i, v := range voted {
+		parts[i] = v.Backend + ": " + field(v.Results)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func NewEnsemble(members []EnsembleMember, policy EnsemblePolicy, weightThreshold float64, minVotes int, logger *slog.Logger) (*Ensemble, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("ensemble needs at least one classifier")
+	}
+
+	switch policy {
+	case PolicyUnanimous, PolicyMajority, PolicyWeighted, PolicyAnyLogAllEmit:
+	case "":
+		policy = PolicyUnanimous
+	default:
+		return nil, fmt.Errorf("unknown ensemble policy %q", policy)
+	}
+
+	if weightThreshold <= 0 {
+		weightThreshold = 0.5
+	}
+
+	if minVotes < 0 || minVotes > len(members) {
+		return nil, fmt.Errorf("min votes must be between 0 and the number of backends, got %d", minVotes)
+	}
+
+	for i := range members {
+		if members[i].Weight <= 0 {
+			members[i].Weight = 1
+		}
+	}
+
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &Ensemble{
+		members:         members,
+		policy:          policy,
+		weightThreshold: weightThreshold,
+		minVotes:        minVotes,
+		logger:          logger.With("component", "ensemble"),
+	}, nil
+}
+
+func (e *Ensemble) Classify(ctx context.Context, input *ClassificationInput) (*Decision, error) {
+	var firstPass, rest []EnsembleMember
+	for _, m := range e.members {
+		if m.FirstPass {
+			firstPass = append(firstPass, m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+
+	var earlier []*Vote
+	if len(firstPass) > 0 && len(rest) > 0 {
+		votes := e.collect(ctx, firstPass, input)
+		if slices.ContainsFunc(votes, func(v *Vote) bool { return v.Err == nil }) {
+			return e.decide(votes)
+		}
+		e.logger.Info("first pass classifiers abstained, asking the rest")
+		earlier = votes
+	} else {
+		rest = e.members
+	}
+
+	votes := e.collect(ctx, rest, input)
+	decision, err := e.decide(votes)
+	if err != nil {
+		return nil, err
+	}
+	decision.Votes = append(earlier, decision.Votes...)
+
+	return decision, nil
+}
+
+// collect asks every member at once
+func (e *Ensemble) collect(ctx context.Context, members []EnsembleMember, input *ClassificationInput) []*Vote {
+	votes := make([]*Vote, len(members))
+
+	var wg sync.WaitGroup
+	for i, m := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results, err := m.Classifier.GetIsBadFaith(ctx, input)
+			backend := m.Classifier.Name()
+			// a fallback chain may have answered with something other than its primary
+			if results != nil && results.Backend != "" {
+				backend = results.Backend
+			}
+			votes[i] = &Vote{
+				Backend: backend,
+				Weight:  m.Weight,
+				Results: results,
+				Err:     err,
+			}
+		}()
+	}
+	wg.Wait()
+
+	return votes
+}
+
+// quorum is how many successful votes out of the ones asked are needed to emit. a configured quorum is capped at the
+// number asked, so a first pass smaller than it can still decide
+func (e *Ensemble) quorum(asked int) int {
+	if e.minVotes == 0 {
+		return asked/2 + 1
+	}
+	return min(e.minVotes, asked)
+}
+
+// decide combines the votes according to the policy. failed votes abstain, and without a quorum of successful votes
+// nothing is emitted, labels the policy would emit go to review instead
+func (e *Ensemble) decide(votes []*Vote) (*Decision, error) {
+	var ok []*Vote
+	var lastErr error
+	for _, v := range votes {
+		if v.Err != nil {
+			e.logger.Warn("classifier failed", "backend", v.Backend, "error", v.Err)
+			lastErr = v.Err
+			continue
+		}
+		ok = append(ok, v)
+	}
+
+	if len(ok) == 0 {
+		return nil, fmt.Errorf("all classifiers failed: %w", lastErr)
+	}
+
+	decision := &Decision{Votes: votes}
+	for _, v := range ok {
+		decision.Backends = append(decision.Backends, v.Backend)
+	}
+
+	quorate := len(ok) >= e.quorum(len(votes))
+	if !quorate {
+		e.logger.Warn("too few classifiers answered to emit labels", "answered", len(ok), "asked", len(votes), "needed", e.quorum(len(votes)))
+	}
+
+	for _, label := range AllLabels {
+		var yes int
+		var yesWeight, totalWeight float64
+		for _, v := range ok {
+			totalWeight += v.Weight
+			if v.Results.Has(label) {
+				yes++
+				yesWeight += v.Weight
+			}
+		}
+
+		if yes == 0 {
+			continue
+		}
+
+		switch e.policy {
+		case PolicyUnanimous:
+			if yes == len(ok) {
+				decision.Emit = append(decision.Emit, label)
+			} else {
+				decision.Review = append(decision.Review, label)
+			}
+		case PolicyMajority:
+			if yes*2 > len(ok) {
+				decision.Emit = append(decision.Emit, label)
+			} else {
+				decision.Review = append(decision.Review, label)
+			}
+		case PolicyWeighted:
+			if yesWeight/totalWeight >= e.weightThreshold {
+				decision.Emit = append(decision.Emit, label)
+			} else {
+				decision.Review = append(decision.Review, label)
+			}
+		case PolicyAnyLogAllEmit:
+			if yes == len(ok) {
+				decision.Emit = append(decision.Emit, label)
+			} else {
+				decision.Log = append(decision.Log, label)
+			}
+		}
+	}
+
+	if !quorate && len(decision.Emit) > 0 {
+		decision.Review = append(decision.Review, decision.Emit...)
+		decision.Emit = nil
+	}
+
+	return decision, nil
+}
+
+type ClassifiersConfig struct {
+	Policy          EnsemblePolicy `json:"policy"`
+	WeightThreshold float64        `json:"weight_threshold"`
+	// MinVotes is how many backends must answer for a label to be emitted, see Ensemble
+	MinVotes int             `json:"min_votes"`
+	Backends []BackendConfig `json:"backends"`
+}
+
+func LoadClassifiersConfig(path string) (*ClassifiersConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read classifiers config: %w", err)
+	}
+
+	var config ClassifiersConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse classifiers config: %w", err)
+	}
+
+	if len(config.Backends) == 0 {
+		return nil, fmt.Errorf("classifiers config has no backends")
+	}
+
+	for i := range config.Backends {
+		if err := validateBackendConfig(&config.Backends[i], fmt.Sprint(i)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &config, nil
+}
+
+// hasBudgetFallback reports whether any backend or fallback switches models once the budget is reached
+func (c *ClassifiersConfig) hasBudgetFallback() bool {
+	for _, b := range c.Backends {
+		if b.BudgetFallbackModel != "" {
+			return true
+		}
+		for _, fb := range b.Fallbacks {
+			if fb.BudgetFallbackModel != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateBackendConfig checks a backend and its fallbacks, filling in the default name and kind
+func validateBackendConfig(b *BackendConfig, id string) error {
+	if b.Host == "" || b.Model == "" {
+		return fmt.Errorf("backend %s is missing a host or model", id)
+	}
+	if b.ApiKey != "" && b.ApiKeyType != "bearer" && b.ApiKeyType != "x-api-key" {
+		return fmt.Errorf("backend %s has a bad api key type. must be either \"bearer\" or \"x-api-key\"", id)
+	}
+	switch b.Kind {
+	case "":
+		b.Kind = BackendKindCompletions
+	case BackendKindCompletions, BackendKindEmbeddings:
+	default:
+		return fmt.Errorf("backend %s has unknown kind %q", id, b.Kind)
+	}
+	if b.Name == "" {
+		b.Name = b.Model
+	}
+	if b.StructuredOutput != "" {
+		if _, err := ParseStructuredOutputMode(string(b.StructuredOutput)); err != nil {
+			return fmt.Errorf("backend %s: %w", id, err)
+		}
+	}
+	if b.Profile != nil {
+		if err := b.Profile.validate(); err != nil {
+			return fmt.Errorf("backend %s has a bad profile: %w", id, err)
+		}
+	}
+
+	for i := range b.Fallbacks {
+		if len(b.Fallbacks[i].Fallbacks) > 0 {
+			return fmt.Errorf("fallback %s.%d can't have fallbacks of its own", id, i)
+		}
+		if err := validateBackendConfig(&b.Fallbacks[i], fmt.Sprintf("%s.%d", id, i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
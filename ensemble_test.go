@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+type fakeClassifier struct {
+	name    string
+	results *BadFaithResults
+	err     error
+}
+
+func (f *fakeClassifier) Name() string {
+	return f.name
+}
+
+func (f *fakeClassifier) GetIsBadFaith(ctx context.Context, input *ClassificationInput) (*BadFaithResults, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	results := *f.results
+	return &results, nil
+}
+
+func badFaithVoter(name string) EnsembleMember {
+	return EnsembleMember{Classifier: &fakeClassifier{name: name, results: &BadFaithResults{BadFaith: true}}}
+}
+
+func cleanVoter(name string) EnsembleMember {
+	return EnsembleMember{Classifier: &fakeClassifier{name: name, results: &BadFaithResults{}}}
+}
+
+func failingVoter(name string) EnsembleMember {
+	return EnsembleMember{Classifier: &fakeClassifier{name: name, err: retryableError(errors.New("unavailable"))}}
+}
+
+func TestEnsembleQuorum(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name       string
+		policy     EnsemblePolicy
+		minVotes   int
+		members    []EnsembleMember
+		wantEmit   []string
+		wantReview []string
+	}{
+		{
+			name:     "quorum of successful votes emits",
+			policy:   PolicyMajority,
+			members:  []EnsembleMember{badFaithVoter("a"), badFaithVoter("b"), failingVoter("c")},
+			wantEmit: []string{LabelBadFaith},
+		},
+		{
+			name:       "a lone successful vote goes to review",
+			policy:     PolicyMajority,
+			members:    []EnsembleMember{badFaithVoter("a"), failingVoter("b"), failingVoter("c")},
+			wantReview: []string{LabelBadFaith},
+		},
+		{
+			name:       "unanimous among too few votes goes to review",
+			policy:     PolicyUnanimous,
+			members:    []EnsembleMember{badFaithVoter("a"), failingVoter("b"), failingVoter("c")},
+			wantReview: []string{LabelBadFaith},
+		},
+		{
+			name:     "min votes lowers the quorum",
+			policy:   PolicyMajority,
+			minVotes: 1,
+			members:  []EnsembleMember{badFaithVoter("a"), failingVoter("b"), failingVoter("c")},
+			wantEmit: []string{LabelBadFaith},
+		},
+		{
+			name:       "min votes raises the quorum",
+			policy:     PolicyMajority,
+			minVotes:   3,
+			members:    []EnsembleMember{badFaithVoter("a"), badFaithVoter("b"), failingVoter("c")},
+			wantReview: []string{LabelBadFaith},
+		},
+		{
+			name:       "a split vote goes to review",
+			policy:     PolicyUnanimous,
+			members:    []EnsembleMember{badFaithVoter("a"), cleanVoter("b")},
+			wantReview: []string{LabelBadFaith},
+		},
+		{
+			name:     "a single member is its own quorum",
+			policy:   PolicyUnanimous,
+			members:  []EnsembleMember{badFaithVoter("a")},
+			wantEmit: []string{LabelBadFaith},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ensemble, err := NewEnsemble(tt.members, tt.policy, 0, tt.minVotes, logger)
+			if err != nil {
+				t.Fatalf("NewEnsemble: %v", err)
+			}
+
+			decision, err := ensemble.Classify(context.Background(), &ClassificationInput{})
+			if err != nil {
+				t.Fatalf("Classify: %v", err)
+			}
+
+			if !slices.Equal(decision.Emit, tt.wantEmit) {
+				t.Errorf("Emit = %v, want %v", decision.Emit, tt.wantEmit)
+			}
+			if !slices.Equal(decision.Review, tt.wantReview) {
+				t.Errorf("Review = %v, want %v", decision.Review, tt.wantReview)
+			}
+		})
+	}
+}
+
+func TestEnsembleAllFailed(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ensemble, err := NewEnsemble([]EnsembleMember{failingVoter("a"), failingVoter("b")}, PolicyMajority, 0, 0, logger)
+	if err != nil {
+		t.Fatalf("NewEnsemble: %v", err)
+	}
+
+	if _, err := ensemble.Classify(context.Background(), &ClassificationInput{}); err == nil {
+		t.Fatal("Classify succeeded with every classifier failing")
+	}
+}
+
+func TestNewEnsembleMinVotes(t *testing.T) {
+	members := []EnsembleMember{badFaithVoter("a"), badFaithVoter("b")}
+	for _, minVotes := range []int{-1, 3} {
+		if _, err := NewEnsemble(members, PolicyMajority, 0, minVotes, nil); err == nil {
+			t.Errorf("NewEnsemble accepted min votes %d for 2 backends", minVotes)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// atprotoTime is the datetime format of label cts and exp
+const atprotoTime = "2006-01-02T15:04:05.000Z"
+
+// LabelTtls is how long each label lasts before it expires on its own. Labels without a ttl are permanent
+type LabelTtls map[string]time.Duration
+
+// ParseLabelTtls parses "label=duration" entries, e.g. "off-topic=72h"
+func ParseLabelTtls(entries []string) (LabelTtls, error) {
+	ttls := make(LabelTtls, len(entries))
+	for _, e := range entries {
+		label, d, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad label ttl %q. must be label=duration", e)
+		}
+		label = strings.TrimSpace(label)
+		if !slices.Contains(AllLabels, label) {
+			return nil, fmt.Errorf("label ttl for unknown label %q", label)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, fmt.Errorf("bad label ttl %q: %w", e, err)
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("label ttl for %s must be positive", label)
+		}
+		ttls[label] = ttl
+	}
+	return ttls, nil
+}
+
+// Exp is when a label emitted at the given time expires, or nil when it doesn't
+func (t LabelTtls) Exp(label string, from time.Time) *time.Time {
+	ttl, ok := t[label]
+	if !ok {
+		return nil
+	}
+	exp := from.Add(ttl)
+	return &exp
+}
+
+// LabelExpiration records a delivered label lapsing at its exp
+type LabelExpiration struct {
+	gorm.Model
+	Uri       string `gorm:"index"`
+	Label     string `gorm:"index"`
+	ExpiredAt time.Time
+	// OutboxEntryID is the delivery of the label that expired
+	OutboxEntryID uint `gorm:"uniqueIndex"`
+}
+
+// ExpirySweeper records delivered labels whose exp has passed. Labels that were negated before they expired are left
+// out, as are deliveries superseded by a later emission of the same label.
+type ExpirySweeper struct {
+	db     *gorm.DB
+	logger *slog.Logger
+}
+
+func NewExpirySweeper(db *gorm.DB, logger *slog.Logger) *ExpirySweeper {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &ExpirySweeper{
+		db:     db,
+		logger: logger.With("component", "expiry-sweeper"),
+	}
+}
+
+func (s *ExpirySweeper) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.sweep(ctx); err != nil {
+			s.logger.Error("failed to sweep expired labels", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *ExpirySweeper) sweep(ctx context.Context) error {
+	var entries []OutboxEntry
+	if err := s.db.WithContext(ctx).
+		Where("state = ? AND NOT neg AND exp IS NOT NULL AND exp <= ?", OutboxDelivered, time.Now()).
+		Where("NOT EXISTS (SELECT 1 FROM label_expirations e WHERE e.outbox_entry_id = outbox_entries.id)").
+		Where("NOT EXISTS (SELECT 1 FROM outbox_entries o WHERE o.uri = outbox_entries.uri AND o.label = outbox_entries.label AND o.state = ? AND o.id > outbox_entries.id AND o.deleted_at IS NULL)", OutboxDelivered).
+		Where("NOT EXISTS (SELECT 1 FROM label_negations n WHERE n.uri = outbox_entries.uri AND n.label = outbox_entries.label AND n.created_at >= outbox_entries.created_at AND n.created_at < outbox_entries.exp AND n.deleted_at IS NULL)").
+		Order("id").
+		Find(&entries).Error; err != nil {
+		return fmt.Errorf("failed to load expired labels: %w", err)
+	}
+
+	for _, e := range entries {
+		row := LabelExpiration{
+			Uri:           e.Uri,
+			Label:         e.Label,
+			ExpiredAt:     *e.Exp,
+			OutboxEntryID: e.ID,
+		}
+		if err := s.db.WithContext(ctx).Create(&row).Error; err != nil {
+			return fmt.Errorf("failed to record label expiration: %w", err)
+		}
+		labelExpirations.WithLabelValues(e.Label).Inc()
+		s.logger.Info("label expired", "uri", e.Uri, "label", e.Label, "exp", e.Exp)
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker stops sending traffic to a backend after it fails too many times in a row. Once the cooldown has
+// passed a single probe request is let through, and its result decides whether the breaker closes or opens again.
+type CircuitBreaker struct {
+	backend   string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	state     circuitState
+	failures  int
+	openUntil time.Time
+}
+
+func NewCircuitBreaker(backend string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	cb := &CircuitBreaker{
+		backend:   backend,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+	circuitStateGauge.WithLabelValues(backend).Set(float64(circuitClosed))
+	return cb
+}
+
+// Allow reports whether a request may be sent. While half open only the one probe is allowed.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Now().Before(cb.openUntil) {
+			return false
+		}
+		cb.setStateLocked(circuitHalfOpen)
+		return true
+	case circuitHalfOpen:
+		// a probe is already in flight
+		return false
+	}
+	return true
+}
+
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures = 0
+	if cb.state != circuitClosed {
+		cb.setStateLocked(circuitClosed)
+	}
+}
+
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		cb.setStateLocked(circuitOpen)
+	}
+}
+
+// Abort releases a request that neither succeeded nor failed in a way that says anything about the backend. A half
+// open probe goes back to open, due right away, so the next request probes again.
+func (cb *CircuitBreaker) Abort() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == circuitHalfOpen {
+		cb.openUntil = time.Now()
+		cb.setStateLocked(circuitOpen)
+	}
+}
+
+func (cb *CircuitBreaker) setStateLocked(state circuitState) {
+	cb.state = state
+	circuitStateGauge.WithLabelValues(cb.backend).Set(float64(state))
+}
+
+func (cb *CircuitBreaker) State() circuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// FallbackClassifier tries an ordered list of backends, skipping any whose circuit breaker is open. The first backend
+// in the list is the primary, and the chain is named after it.
+type FallbackClassifier struct {
+	backends []Classifier
+	breakers []*CircuitBreaker
+	logger   *slog.Logger
+}
+
+func NewFallbackClassifier(backends []Classifier, failureThreshold int, cooldown time.Duration, logger *slog.Logger) (*FallbackClassifier, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("fallback chain needs at least one backend")
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	breakers := make([]*CircuitBreaker, len(backends))
+	for i, b := range backends {
+		breakers[i] = NewCircuitBreaker(b.Name(), failureThreshold, cooldown)
+	}
+
+	return &FallbackClassifier{
+		backends: backends,
+		breakers: breakers,
+		logger:   logger.With("component", "fallback", "primary", backends[0].Name()),
+	}, nil
+}
+
+func (f *FallbackClassifier) Name() string {
+	return f.backends[0].Name()
+}
+
+func (f *FallbackClassifier) GetIsBadFaith(ctx context.Context, input *ClassificationInput) (*BadFaithResults, error) {
+	var errs []error
+	for i, b := range f.backends {
+		cb := f.breakers[i]
+		if !cb.Allow() {
+			continue
+		}
+
+		results, err := b.GetIsBadFaith(ctx, input)
+		if err == nil {
+			cb.Success()
+			if i > 0 {
+				f.logger.Info("classified with fallback backend", "backend", b.Name())
+			}
+			return results, nil
+		}
+
+		// the caller giving up says nothing about the backend
+		if ctx.Err() != nil {
+			cb.Abort()
+			return nil, err
+		}
+
+		// permanent errors, like a 4xx or the embeddings backend abstaining, mean the backend is up but couldn't
+		// answer this one. the next backend is still asked, but the breaker isn't tripped by it
+		if isPermanent(err) {
+			cb.Abort()
+			f.logger.Info("backend couldn't classify, trying next", "backend", b.Name(), "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
+			continue
+		}
+
+		cb.Failure()
+		if cb.State() == circuitOpen {
+			f.logger.Warn("backend failed, circuit open", "backend", b.Name(), "error", err)
+		} else {
+			f.logger.Warn("backend failed, trying next", "backend", b.Name(), "error", err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("every backend's circuit is open")
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+type FewShotStrategy string
+
+const (
+	// any reviewed examples
+	FewShotRandom FewShotStrategy = "random"
+	// take turns between examples of each label, and examples with no labels
+	FewShotBalanced FewShotStrategy = "balanced"
+	// the examples sharing the most words with the current parent and reply
+	FewShotSimilar FewShotStrategy = "similar"
+)
+
+// how often to reload the pool of reviewed examples from the log db
+const fewShotRefreshInterval = 5 * time.Minute
+
+// FewShotExample is a reviewed reply along with the labels a reviewer confirmed for it
+type FewShotExample struct {
+	AuthorUri string
+	Parent    string
+	Reply     string
+	Results   BadFaithResults
+	// Rationale is the one logged with the reply, kept only when the reviewer confirmed every label it was logged with
+	Rationale string
+
+	words    map[string]struct{}
+	rejected bool
+	// reviewed holds the labels a reviewer looked at, and clean is set when they confirmed no labels apply
+	reviewed map[string]bool
+	clean    bool
+}
+
+// complete reports whether the reviewers said something about every label, so that the labels shown as false in the
+// answer were actually judged not to apply rather than never looked at
+func (ex *FewShotExample) complete() bool {
+	if ex.clean {
+		return len(ex.Results.Labels()) == 0
+	}
+	for _, l := range AllLabels {
+		if !ex.reviewed[l] {
+			return false
+		}
+	}
+	return true
+}
+
+// answer is what the model should have said for the example. Only examples with a rationale are selected when one is
+// asked for, see ExampleSelector.Select
+func (ex *FewShotExample) answer(rationale bool) map[string]any {
+	obj := ex.Results.object()
+	if rationale {
+		obj["rationale"] = ex.Rationale
+	}
+	return obj
+}
+
+func (ex *FewShotExample) tokens() int {
+	// roughly four bytes per token, plus the answer
+	return (len(ex.Parent)+len(ex.Reply)+len(ex.Rationale))/4 + 20
+}
+
+// ExampleSelector picks reviewed replies from the log db to show the model as demonstrations before the real reply
+type ExampleSelector struct {
+	db        *gorm.DB
+	strategy  FewShotStrategy
+	count     int
+	maxTokens int
+	logger    *slog.Logger
+
+	mu       sync.Mutex
+	pool     []*FewShotExample
+	version  string
+	loadedAt time.Time
+}
+
+func NewExampleSelector(db *gorm.DB, strategy FewShotStrategy, count, maxTokens int, logger *slog.Logger) (*ExampleSelector, error) {
+	switch strategy {
+	case FewShotRandom, FewShotBalanced, FewShotSimilar:
+	default:
+		return nil, fmt.Errorf("unknown few shot strategy %q", strategy)
+	}
+
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &ExampleSelector{
+		db:        db,
+		strategy:  strategy,
+		count:     count,
+		maxTokens: maxTokens,
+		logger:    logger.With("component", "fewshot"),
+	}, nil
+}
+
+// refreshLocked reloads the pool once it is older than the refresh interval. a reply is an example once a reviewer
+// confirmed it has no labels, or reviewed a log row for every label. confirmed labels are shown as true and rejected
+// ones as false.
+func (s *ExampleSelector) refreshLocked(ctx context.Context) {
+	if time.Since(s.loadedAt) < fewShotRefreshInterval {
+		return
+	}
+	s.loadedAt = time.Now()
+
+	var items []LogItem
+	if err := s.db.WithContext(ctx).Where("reviewed = ?", true).Order("id").Find(&items).Error; err != nil {
+		s.logger.Error("failed to load reviewed examples", "error", err)
+		return
+	}
+
+	var pool []*FewShotExample
+	byUri := make(map[string]*FewShotExample)
+	// a rejected no-labels row says the reply should have had labels, but not which ones
+	unusable := make(map[string]bool)
+	for _, item := range items {
+		if item.AuthorText == "" {
+			continue
+		}
+		if item.Label == LabelNoLabels && !item.Confirmed {
+			unusable[item.AuthorUri] = true
+		}
+		ex, ok := byUri[item.AuthorUri]
+		if !ok {
+			ex = &FewShotExample{
+				AuthorUri: item.AuthorUri,
+				Parent:    item.ParentText,
+				Reply:     item.AuthorText,
+				words:     wordSet(item.ParentText + " " + item.AuthorText),
+				reviewed:  make(map[string]bool),
+			}
+			byUri[item.AuthorUri] = ex
+			pool = append(pool, ex)
+		}
+		ex.reviewed[item.Label] = true
+		switch {
+		case item.Label == LabelNoLabels:
+			ex.clean = item.Confirmed
+		case item.Confirmed:
+			ex.Results.Set(item.Label, true)
+		default:
+			ex.rejected = true
+		}
+		if ex.Rationale == "" {
+			ex.Rationale = item.Rationale
+		}
+	}
+
+	pool = slices.DeleteFunc(pool, func(ex *FewShotExample) bool { return unusable[ex.AuthorUri] || !ex.complete() })
+	// a rationale for labels the reviewer rejected would teach the model the wrong answer
+	for _, ex := range pool {
+		if ex.rejected {
+			ex.Rationale = ""
+		}
+	}
+
+	uris := make([]string, len(pool))
+	for i, ex := range pool {
+		uris[i] = ex.AuthorUri + " " + strings.Join(ex.Results.Labels(), ",")
+	}
+
+	s.pool = pool
+	s.version = classificationCacheKey(string(s.strategy), fmt.Sprint(s.count, s.maxTokens), strings.Join(uris, "\n"))[:16]
+	s.logger.Info("loaded few shot examples", "count", len(pool))
+}
+
+// Version changes whenever the pool or the selection settings do, so it can be used in cache keys
+func (s *ExampleSelector) Version(ctx context.Context) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked(ctx)
+	return s.version
+}
+
+// Select returns the examples to show before the given input, in the order they should be shown. With rationale set,
+// only examples that have a logged rationale are picked.
+func (s *ExampleSelector) Select(ctx context.Context, input *ClassificationInput, rationale bool) []*FewShotExample {
+	if s == nil || s.count <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.refreshLocked(ctx)
+	pool := s.pool
+	s.mu.Unlock()
+
+	// never show the reply being classified as its own example
+	self := usageAttributionFrom(ctx).Uri
+	candidates := make([]*FewShotExample, 0, len(pool))
+	for _, ex := range pool {
+		if ex.AuthorUri != self && (!rationale || ex.Rationale != "") {
+			candidates = append(candidates, ex)
+		}
+	}
+
+	var ordered []*FewShotExample
+	switch s.strategy {
+	case FewShotRandom:
+		ordered = candidates
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	case FewShotBalanced:
+		ordered = balancedOrder(candidates)
+	case FewShotSimilar:
+		words := wordSet(input.Parent.Text + " " + input.Reply.Text)
+		scores := make(map[*FewShotExample]float64, len(candidates))
+		for _, ex := range candidates {
+			scores[ex] = jaccard(words, ex.words)
+		}
+		ordered = slices.Clone(candidates)
+		slices.SortStableFunc(ordered, func(a, b *FewShotExample) int {
+			switch {
+			case scores[a] > scores[b]:
+				return -1
+			case scores[a] < scores[b]:
+				return 1
+			}
+			return 0
+		})
+	}
+
+	var selected []*FewShotExample
+	tokens := 0
+	for _, ex := range ordered {
+		if len(selected) == s.count {
+			break
+		}
+		if s.maxTokens > 0 && tokens+ex.tokens() > s.maxTokens {
+			continue
+		}
+		tokens += ex.tokens()
+		selected = append(selected, ex)
+	}
+
+	// the most similar example goes last, right before the real reply
+	if s.strategy == FewShotSimilar {
+		slices.Reverse(selected)
+	}
+
+	return selected
+}
+
+// balancedOrder shuffles the examples of each label, and those with no labels, then takes one from each in turn
+func balancedOrder(examples []*FewShotExample) []*FewShotExample {
+	buckets := make([][]*FewShotExample, len(AllLabels)+1)
+	for _, ex := range examples {
+		labels := ex.Results.Labels()
+		if len(labels) == 0 {
+			buckets[len(AllLabels)] = append(buckets[len(AllLabels)], ex)
+			continue
+		}
+		// examples with several labels count towards a random one of them, so they aren't picked twice
+		i := slices.Index(AllLabels, labels[rand.IntN(len(labels))])
+		buckets[i] = append(buckets[i], ex)
+	}
+
+	for _, b := range buckets {
+		rand.Shuffle(len(b), func(i, j int) { b[i], b[j] = b[j], b[i] })
+	}
+
+	ordered := make([]*FewShotExample, 0, len(examples))
+	for len(ordered) < len(examples) {
+		for i, b := range buckets {
+			if len(b) == 0 {
+				continue
+			}
+			ordered = append(ordered, b[0])
+			buckets[i] = b[1:]
+		}
+	}
+
+	return ordered
+}
+
+func wordSet(text string) map[string]struct{} {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	set := make(map[string]struct{}, len(words))
+	for _, w := range words {
+		set[w] = struct{}{}
+	}
+	return set
+}
+
+func jaccard(a, b map[string]struct{}) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for w := range a {
+		if _, ok := b[w]; ok {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/jetstream/pkg/models"
+	"gorm.io/gorm"
 )
 
 func (dsmt *DontShowMeThis) handlePost(ctx context.Context, event *models.Event, post *bsky.FeedPost) error {
@@ -15,14 +20,17 @@ func (dsmt *DontShowMeThis) handlePost(ctx context.Context, event *models.Event,
 		return nil
 	}
 
-	var parentUri string
+	var parentUri, replyType string
 
 	if post.Reply != nil && post.Reply.Parent != nil {
 		parentUri = post.Reply.Parent.Uri
+		replyType = ReplyTypeReply
 	} else if post.Embed != nil && post.Embed.EmbedRecord != nil && post.Embed.EmbedRecord.Record != nil {
 		parentUri = post.Embed.EmbedRecord.Record.Uri
+		replyType = ReplyTypeQuote
 	} else if post.Embed != nil && post.Embed.EmbedRecordWithMedia != nil && post.Embed.EmbedRecordWithMedia.Record != nil && post.Embed.EmbedRecordWithMedia.Record.Record != nil {
 		parentUri = post.Embed.EmbedRecordWithMedia.Record.Record.Uri
+		replyType = ReplyTypeQuote
 	}
 
 	if parentUri == "" {
@@ -37,7 +45,8 @@ func (dsmt *DontShowMeThis) handlePost(ctx context.Context, event *models.Event,
 	opDid := atUri.Authority().String()
 	_, isWatchedOp := dsmt.watchedOps[opDid]
 	_, isWatchedLogOp := dsmt.watchedLogOps[opDid]
-	if !isWatchedOp && !isWatchedLogOp {
+	isShadowOp := dsmt.isShadowOp(opDid)
+	if !isWatchedOp && !isWatchedLogOp && !isShadowOp {
 		return nil
 	}
 
@@ -47,37 +56,94 @@ func (dsmt *DontShowMeThis) handlePost(ctx context.Context, event *models.Event,
 
 	logger.Info("ingested reply to watched op")
 
-	if post.Text == "" {
-		logger.Info("post contained no text, skipping")
+	reply := dsmt.buildPostContent(ctx, post)
+	if dsmt.visionEnabled {
+		reply.Images = dsmt.fetchImages(ctx, event.Did, post)
+	}
+
+	if reply.Empty() {
+		logger.Info("post contained nothing to classify, skipping")
 		return nil
 	}
 
-	parent, err := dsmt.getPost(ctx, parentUri)
-	if err != nil {
-		return fmt.Errorf("failed to get parent post: %w", err)
+	lang := postLanguage(post.Langs, post.Text)
+	if dsmt.languages.Skips(opDid, lang) {
+		logger.Info("reply is in a skipped language, skipping", "lang", lang)
+		return nil
+	}
+	if lang != "" {
+		logger = logger.With("lang", lang)
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+	// rules match on the detected language when the post doesn't declare one
+	langs := post.Langs
+	if len(langs) == 0 && lang != "" {
+		langs = []string{lang}
+	}
+
+	domains := make([]string, len(reply.Links))
+	for i, l := range reply.Links {
+		domains[i] = l.Domain
+	}
+
+	// the rendered post includes link titles and alt text, which can carry instructions just as well as the text
+	injection := DetectInjection(reply.Render())
+	if len(injection) > 0 {
+		logger.Warn("reply looks like a prompt injection", "patterns", injection)
+	}
 
-	results, err := dsmt.lmstudioc.GetIsBadFaith(ctx, parent.Text, post.Text)
+	rule := dsmt.rules.Match(&RuleSubject{
+		Text:      post.Text,
+		Domains:   domains,
+		AuthorDid: event.Did,
+		ReplyType: replyType,
+		Langs:     langs,
+		Injection: len(injection) > 0,
+		Replier: func() *ReplierContext {
+			return dsmt.lookupReplierContext(ctx, opDid, event.Did)
+		},
+	})
+	if rule != nil {
+		if err := dsmt.recordRuleHit(ctx, rule, event.Did, uri, parentUri); err != nil {
+			return fmt.Errorf("failed to insert rule hit: %w", err)
+		}
+		logger = logger.With("rule", rule.Name)
+		logger.Info("matched rule", "action", rule.Action)
+
+		if rule.Action == RuleActionSkip {
+			return nil
+		}
+	}
+
+	parent, err := dsmt.getPost(ctx, parentUri)
 	if err != nil {
-		return fmt.Errorf("failed to check bad faith: %w", err)
+		return fmt.Errorf("failed to get parent post: %w", err)
 	}
 
-	labels := []string{}
-	if results.BadFaith {
-		labels = append(labels, LabelBadFaith)
+	input := &ClassificationInput{
+		Ancestors: dsmt.buildAncestry(ctx, parent, opDid, event.Did),
+		Parent:    dsmt.buildPostContent(ctx, parent),
+		Reply:     reply,
+		Replier:   dsmt.buildReplierContext(ctx, opDid, event.Did),
+		Lang:      lang,
 	}
-	if results.OffTopic {
-		labels = append(labels, LabelOffTopic)
+
+	if dsmt.visionEnabled {
+		input.Parent.Images = dsmt.fetchImages(ctx, opDid, parent)
 	}
-	if results.Funny {
-		labels = append(labels, LabelFunny)
+
+	logOnly := rule != nil && rule.Action == RuleActionLogOnly
+	if !logOnly && dsmt.usage.LogOnly() {
+		if rule != nil && rule.Action == RuleActionClassify {
+			logger.Warn("completions budget reached, classifying anyway because of rule")
+		} else {
+			logger.Warn("completions budget reached, skipping classification")
+			logOnly = true
+		}
 	}
 
-	if len(labels) == 0 {
-		if dsmt.logNoLabels && dsmt.db != nil {
+	if logOnly {
+		if dsmt.db != nil {
 			item := LogItem{
 				ParentDid:  opDid,
 				AuthorDid:  event.Did,
@@ -85,45 +151,238 @@ func (dsmt *DontShowMeThis) handlePost(ctx context.Context, event *models.Event,
 				AuthorUri:  uri,
 				ParentText: parent.Text,
 				AuthorText: post.Text,
-				Label:      "no-labels",
+				Label:      LabelUnclassified,
+				Lang:       lang,
 			}
-
 			if err := dsmt.db.Create(&item).Error; err != nil {
 				return fmt.Errorf("failed to insert log: %w", err)
 			}
-			logger.Info("logged", "label", "no-labels")
+		}
+		logger.Info("logged without classifying", "label", LabelUnclassified)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var decision *Decision
+	if rule != nil && rule.Action == RuleActionEmit {
+		decision = &Decision{Emit: []string{rule.Label}, Backends: []string{"rule:" + rule.Name}}
+	} else {
+		ctx = withUsageAttribution(ctx, opDid, uri)
+
+		dsmt.translateInput(ctx, logger, input, parent.Langs)
+
+		decision, err = dsmt.classifier.Classify(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to check bad faith: %w", err)
+		}
+
+		dsmt.usage.AttributeLabels(ctx, uri, slices.Concat(decision.Emit, decision.Log, decision.Review))
+
+		if err := dsmt.logVotes(uri, parentUri, decision.Votes); err != nil {
+			return fmt.Errorf("failed to insert votes: %w", err)
+		}
+	}
+
+	// the patterns also match people just talking about prompts, so a detector hit alone goes to review unless
+	// INJECTION_EMIT is set. without a log db there is nowhere to review it, and the label is emitted instead
+	if len(injection) > 0 {
+		if dsmt.injectionEmit || dsmt.db == nil {
+			decision.emitLabel(LabelPromptInjection, "detector")
+		} else {
+			decision.reviewLabel(LabelPromptInjection, "detector")
+		}
+	}
+
+	newLogItem := func(label string) *LogItem {
+		return &LogItem{
+			ParentDid:  opDid,
+			AuthorDid:  event.Did,
+			ParentUri:  parentUri,
+			AuthorUri:  uri,
+			ParentText: parent.Text,
+			AuthorText: post.Text,
+			Label:      label,
+			Lang:       lang,
+			Backend:    strings.Join(decision.Backends, ","),
+			Rationale:  decision.Rationale(),
+			Reasoning:  decision.Reasoning(),
+		}
+	}
+
+	if decision.Empty() {
+		if dsmt.logNoLabels && dsmt.db != nil {
+			if err := dsmt.db.Create(newLogItem(LabelNoLabels)).Error; err != nil {
+				return fmt.Errorf("failed to insert log: %w", err)
+			}
+			logger.Info("logged", "label", LabelNoLabels)
 		} else {
 			logger.Info("no labels to emit or log")
 		}
 		return nil
 	}
 
-	for _, l := range labels {
-		if isWatchedOp {
-			if err := dsmt.emitLabel(ctx, uri, l); err != nil {
-				return fmt.Errorf("failed to label post with %s: %w", l, err)
+	if isShadowOp {
+		if err := dsmt.recordShadowLabels(opDid, event.Did, uri, parentUri, decision); err != nil {
+			return fmt.Errorf("failed to record shadow labels: %w", err)
+		}
+		logger.Info("recorded shadow labels", "labels", decision.Emit)
+	}
+
+	if err := dsmt.emitLabels(ctx, logger, uri, decision.Emit, isWatchedOp && !isShadowOp, newLogItem); err != nil {
+		return err
+	}
+
+	for _, l := range decision.Log {
+		if dsmt.db == nil {
+			logger.Info("label only meant for log, but no log db configured", "label", l)
+			continue
+		}
+		if err := dsmt.db.Create(newLogItem(l)).Error; err != nil {
+			return fmt.Errorf("failed to insert log: %w", err)
+		}
+		logger.Info("logged", "label", l)
+	}
+
+	for _, l := range decision.Review {
+		if dsmt.db == nil {
+			logger.Info("classifiers disagreed, but no log db configured for review", "label", l)
+			continue
+		}
+		item := newLogItem(l)
+		item.NeedsReview = true
+		if err := dsmt.db.Create(item).Error; err != nil {
+			return fmt.Errorf("failed to insert review log: %w", err)
+		}
+		logger.Info("classifiers disagreed, logged for review", "label", l)
+	}
+
+	// replies to ops in SHADOW_OPS don't count towards account labels, which apply across every op. with --shadow the
+	// account labeler records its labels as shadow labels instead
+	_, isShadowOnlyOp := dsmt.shadowOps[opDid]
+	if dsmt.accounts != nil && !isShadowOnlyOp && (slices.Contains(decision.Emit, LabelBadFaith) || slices.Contains(decision.Log, LabelBadFaith)) {
+		if err := dsmt.accounts.Observe(event.Did); err != nil {
+			logger.Error("failed to update account label", "error", err)
+		}
+	}
+
+	return nil
+}
+
+// emitLabels logs and emits the labels the decision settled on. with a log db the label is queued in the outbox in the
+// same transaction as its log row, and the outbox worker delivers it. without one it is sent straight to the emitter.
+func (dsmt *DontShowMeThis) emitLabels(ctx context.Context, logger *slog.Logger, uri string, labels []string, emit bool, newLogItem func(string) *LogItem) error {
+	if dsmt.db == nil {
+		if !emit {
+			return nil
+		}
+		var errs []error
+		for _, l := range labels {
+			if err := dsmt.emitLabel(ctx, uri, l, dsmt.labelTtls.Exp(l, time.Now())); err != nil {
+				logger.Error("failed to emit label", "label", l, "error", err)
+				errs = append(errs, fmt.Errorf("failed to label post with %s: %w", l, err))
+				continue
 			}
 			logger.Info("emitted label", "label", l)
 		}
+		return errors.Join(errs...)
+	}
 
+	queued := false
+	for _, l := range labels {
 		_, isLoggedLabel := dsmt.loggedLabels[l]
-		if dsmt.db != nil && isLoggedLabel {
-			item := LogItem{
-				ParentDid:  opDid,
-				AuthorDid:  event.Did,
-				ParentUri:  parentUri,
-				AuthorUri:  uri,
-				ParentText: parent.Text,
-				AuthorText: post.Text,
-				Label:      l,
-			}
+		if !emit && !isLoggedLabel {
+			continue
+		}
 
-			if err := dsmt.db.Create(&item).Error; err != nil {
-				return fmt.Errorf("failed to insert log: %w", err)
+		if err := dsmt.db.Transaction(func(tx *gorm.DB) error {
+			if isLoggedLabel {
+				if err := tx.Create(newLogItem(l)).Error; err != nil {
+					return fmt.Errorf("failed to insert log: %w", err)
+				}
 			}
+			if emit {
+				return enqueueLabel(tx, uri, l, false, dsmt.labelTtls.Exp(l, time.Now()))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if isLoggedLabel {
 			logger.Info("logged", "label", l)
 		}
+		if emit {
+			logger.Info("queued label", "label", l)
+			queued = true
+		}
+	}
+
+	if queued && dsmt.outbox != nil {
+		dsmt.outbox.Notify()
 	}
 
 	return nil
 }
+
+// logVotes records each backend's individual answer. with a single backend the vote is the decision, so nothing is stored
+func (dsmt *DontShowMeThis) logVotes(uri, parentUri string, votes []*Vote) error {
+	if dsmt.db == nil || len(votes) < 2 {
+		return nil
+	}
+
+	rows := make([]ClassifierVote, 0, len(votes))
+	for _, v := range votes {
+		row := ClassifierVote{
+			AuthorUri: uri,
+			ParentUri: parentUri,
+			Backend:   v.Backend,
+			Weight:    v.Weight,
+		}
+		if v.Err != nil {
+			row.Error = v.Err.Error()
+		} else {
+			row.BadFaith = v.Results.BadFaith
+			row.OffTopic = v.Results.OffTopic
+			row.Funny = v.Results.Funny
+			row.PromptInjection = v.Results.PromptInjection
+			row.Rationale = v.Results.Rationale
+			row.Reasoning = v.Results.Reasoning
+		}
+		rows = append(rows, row)
+	}
+
+	return dsmt.db.Create(&rows).Error
+}
+
+// translateInput translates the parent and reply when they aren't in the language the models are best at, and picks
+// the prompt for the reply's language. failed translations are logged and the original text is classified instead.
+func (dsmt *DontShowMeThis) translateInput(ctx context.Context, logger *slog.Logger, input *ClassificationInput, parentLangs []string) {
+	translated := false
+	if dsmt.translator != nil {
+		if dsmt.languages.ShouldTranslate(input.Lang) {
+			text, err := dsmt.translator.Translate(ctx, input.Reply.Text, input.Lang)
+			if err != nil {
+				logger.Warn("failed to translate reply, classifying the original", "error", err)
+			} else {
+				input.Reply.OriginalText = input.Reply.Text
+				input.Reply.Text = text
+				translated = true
+			}
+		}
+
+		parentLang := postLanguage(parentLangs, input.Parent.Text)
+		if dsmt.languages.ShouldTranslate(parentLang) {
+			text, err := dsmt.translator.Translate(ctx, input.Parent.Text, parentLang)
+			if err != nil {
+				logger.Warn("failed to translate parent, classifying the original", "error", err)
+			} else {
+				input.Parent.OriginalText = input.Parent.Text
+				input.Parent.Text = text
+			}
+		}
+	}
+
+	input.LangPrompt = dsmt.languages.Prompt(input.Lang, translated)
+}
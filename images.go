@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// ImageInput is an image attached to a post, ready to be sent to a vision capable backend
+type ImageInput struct {
+	MimeType string
+	Data     []byte
+	Alt      string
+}
+
+func (i *ImageInput) DataURL() string {
+	return "data:" + i.MimeType + ";base64," + base64.StdEncoding.EncodeToString(i.Data)
+}
+
+func (i *ImageInput) Hash() string {
+	sum := sha256.Sum256(i.Data)
+	return hex.EncodeToString(sum[:])
+}
+
+// postImages returns the image embeds of a post, either directly attached or alongside a quoted record
+func postImages(post *bsky.FeedPost) []*bsky.EmbedImages_Image {
+	if post.Embed == nil {
+		return nil
+	}
+	if post.Embed.EmbedImages != nil {
+		return post.Embed.EmbedImages.Images
+	}
+	if post.Embed.EmbedRecordWithMedia != nil && post.Embed.EmbedRecordWithMedia.Media != nil && post.Embed.EmbedRecordWithMedia.Media.EmbedImages != nil {
+		return post.Embed.EmbedRecordWithMedia.Media.EmbedImages.Images
+	}
+	return nil
+}
+
+// fetchImages downloads the images attached to a post from the author's pds. Images that are too big or fail to
+// download are skipped, so a post can come back with fewer images than it has.
+func (dsmt *DontShowMeThis) fetchImages(ctx context.Context, did string, post *bsky.FeedPost) []ImageInput {
+	embeds := postImages(post)
+	if len(embeds) == 0 {
+		return nil
+	}
+
+	logger := dsmt.logger.With("did", did)
+
+	pdsc, err := dsmt.pdsClient(ctx, did)
+	if err != nil {
+		logger.Warn("failed to resolve pds for images", "error", err)
+		return nil
+	}
+
+	images := make([]ImageInput, 0, len(embeds))
+	for _, embed := range embeds {
+		if embed.Image == nil {
+			continue
+		}
+		if dsmt.imageMaxBytes > 0 && embed.Image.Size > dsmt.imageMaxBytes {
+			logger.Info("skipping image over size limit", "size", embed.Image.Size)
+			continue
+		}
+
+		cid := embed.Image.Ref.String()
+		data, err := dsmt.getBlob(ctx, pdsc, did, cid)
+		if err != nil {
+			logger.Warn("failed to get image blob", "cid", cid, "error", err)
+			continue
+		}
+
+		img, err := prepareImage(data, embed.Image.MimeType, dsmt.imageMaxDimension)
+		if err != nil {
+			logger.Warn("failed to prepare image", "cid", cid, "error", err)
+			continue
+		}
+		img.Alt = embed.Alt
+
+		images = append(images, *img)
+	}
+
+	return images
+}
+
+// getBlob downloads a blob, giving up once it reads more than IMAGE_MAX_BYTES. The size in the post's embed is
+// whatever the author wrote there, so the pds may well send more than it says.
+func (dsmt *DontShowMeThis) getBlob(ctx context.Context, pdsc *xrpc.Client, did, cid string) ([]byte, error) {
+	params := url.Values{"did": {did}, "cid": {cid}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pdsc.Host+"/xrpc/com.atproto.sync.getBlob?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create blob request: %w", err)
+	}
+
+	resp, err := pdsc.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("received invalid status code from pds: %d", resp.StatusCode)
+	}
+
+	if dsmt.imageMaxBytes <= 0 {
+		return io.ReadAll(resp.Body)
+	}
+
+	if resp.ContentLength > dsmt.imageMaxBytes {
+		return nil, fmt.Errorf("blob is over the size limit: %d bytes", resp.ContentLength)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, dsmt.imageMaxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+	if int64(len(data)) > dsmt.imageMaxBytes {
+		return nil, fmt.Errorf("blob is over the size limit of %d bytes", dsmt.imageMaxBytes)
+	}
+
+	return data, nil
+}
+
+func (dsmt *DontShowMeThis) pdsClient(ctx context.Context, did string) (*xrpc.Client, error) {
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse did: %w", err)
+	}
+
+	ident, err := dsmt.directory.LookupDID(ctx, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup did: %w", err)
+	}
+
+	pds := ident.PDSEndpoint()
+	if pds == "" {
+		return nil, fmt.Errorf("did has no pds endpoint")
+	}
+
+	return &xrpc.Client{
+		Host:   pds,
+		Client: dsmt.httpc,
+	}, nil
+}
+
+// maxImagePixels caps the pixels of an image that is decoded at all, when images aren't downscaled. A few kilobytes
+// of png can declare billions of pixels, and decoding allocates all of them up front
+const maxImagePixels = 40_000_000
+
+// prepareImage downscales an image so its longest side fits within maxDimension. Formats the standard library can't
+// decode are passed through untouched. Images with more pixels than could sensibly be downscaled are rejected before
+// they are decoded.
+func prepareImage(data []byte, mimeType string, maxDimension int) (*ImageInput, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		if mimeType == "" {
+			return nil, fmt.Errorf("failed to decode image of unknown type: %w", err)
+		}
+		return &ImageInput{MimeType: mimeType, Data: data}, nil
+	}
+
+	limit := int64(maxImagePixels)
+	if maxDimension > 0 {
+		limit = 16 * int64(maxDimension) * int64(maxDimension)
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > limit {
+		return nil, fmt.Errorf("image is too big to decode: %dx%d", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if maxDimension <= 0 || (w <= maxDimension && h <= maxDimension) {
+		return &ImageInput{MimeType: mimeType, Data: data}, nil
+	}
+
+	scale := float64(maxDimension) / float64(max(w, h))
+	nw, nh := max(int(float64(w)*scale), 1), max(int(float64(h)*scale), 1)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, downscale(img, nw, nh), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, fmt.Errorf("failed to encode downscaled image: %w", err)
+	}
+
+	return &ImageInput{MimeType: "image/jpeg", Data: buf.Bytes()}, nil
+}
+
+// downscale resizes by averaging the source pixels that fall into each destination pixel
+func downscale(src image.Image, nw, nh int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, nw, nh))
+
+	for y := range nh {
+		y0 := bounds.Min.Y + y*h/nh
+		y1 := max(bounds.Min.Y+(y+1)*h/nh, y0+1)
+		for x := range nw {
+			x0 := bounds.Min.X + x*w/nw
+			x1 := max(bounds.Min.X+(x+1)*w/nw, x0+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	return dst
+}
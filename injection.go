@@ -0,0 +1,56 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+)
+
+type injectionPattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// common ways replies try to talk to the classifier instead of the people reading them. these are cheap to run on
+// every reply and catch the lazy attempts, the model is asked to flag the rest.
+var injectionPatterns = []injectionPattern{
+	{"ignore-instructions", regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\b.{0,30}\b(previous|prior|above|earlier|all|your|the)\b.{0,20}\b(instructions?|prompts?|rules|directions)\b`)},
+	{"new-instructions", regexp.MustCompile(`(?i)\b(new|updated|real|actual)\s+(system\s+)?(instructions?|rules|directives?)\s*:`)},
+	{"system-prompt", regexp.MustCompile(`(?i)\b(system\s+prompt|developer\s+mode|jailbreak)\b`)},
+	{"role-play", regexp.MustCompile(`(?i)\b(you\s+are\s+now|from\s+now\s+on\s+you|act\s+as\s+(an?\s+)?(ai|assistant|classifier|moderator))\b`)},
+	{"role-tags", regexp.MustCompile(`(?i)(</?\s*(system|assistant|user|parent|reply|post)\s*>|\[/?INST\]|<\|im_(start|end)\|>|<<SYS>>)`)},
+	{"answer-injection", regexp.MustCompile(`(?i)["']?\b(bad_faith|off_topic|funny|prompt_injection)\b["']?\s*[:=]\s*(true|false)`)},
+	{"classifier-address", regexp.MustCompile(`(?i)\b(dear|attention|note\s+to\s+the|hey)\s+(ai|llm|language\s+model|classifier|moderation\s+bot)\b`)},
+}
+
+// DetectInjection returns the names of the injection patterns that match any of the given texts
+func DetectInjection(texts ...string) []string {
+	var matched []string
+	for _, p := range injectionPatterns {
+		if slices.ContainsFunc(texts, p.re.MatchString) {
+			matched = append(matched, p.name)
+		}
+	}
+	return matched
+}
+
+// emitLabel adds the label to the ones the decision emits, taking it out of the log and review
+func (d *Decision) emitLabel(label, backend string) {
+	if slices.Contains(d.Emit, label) {
+		return
+	}
+	d.Log = slices.DeleteFunc(d.Log, func(l string) bool { return l == label })
+	d.Review = slices.DeleteFunc(d.Review, func(l string) bool { return l == label })
+	d.Emit = append(d.Emit, label)
+	d.Backends = append(d.Backends, backend)
+}
+
+// reviewLabel sends the label to review, unless the decision already emits it. A label only meant for the log is
+// moved to review, since a person should look at it either way.
+func (d *Decision) reviewLabel(label, backend string) {
+	if slices.Contains(d.Emit, label) || slices.Contains(d.Review, label) {
+		return
+	}
+	d.Log = slices.DeleteFunc(d.Log, func(l string) bool { return l == label })
+	d.Review = append(d.Review, label)
+	d.Backends = append(d.Backends, backend)
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+const (
+	// how many labels to load at a time when replaying from a cursor
+	labelBackfillPage = 500
+	// how many live labels a subscriber can fall behind by before it is disconnected
+	labelSubscriberBuffer = 1000
+)
+
+// SignedLabel is a label created by the built in labeler. Its ID is the label's sequence number in subscribeLabels.
+type SignedLabel struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Src       string
+	Uri       string `gorm:"index"`
+	Cid       string
+	Val       string `gorm:"index"`
+	Neg       bool
+	Cts       string
+	// Exp is when the label expires, empty for labels that don't
+	Exp string
+	Sig []byte
+}
+
+func (l *SignedLabel) lexicon() *comatproto.LabelDefs_Label {
+	ver := int64(1)
+	lbl := &comatproto.LabelDefs_Label{
+		Cts: l.Cts,
+		Src: l.Src,
+		Uri: l.Uri,
+		Val: l.Val,
+		Ver: &ver,
+		Sig: l.Sig,
+	}
+	if l.Cid != "" {
+		cid := l.Cid
+		lbl.Cid = &cid
+	}
+	if l.Neg {
+		neg := true
+		lbl.Neg = &neg
+	}
+	if l.Exp != "" {
+		exp := l.Exp
+		lbl.Exp = &exp
+	}
+	return lbl
+}
+
+// Labeler signs labels with the labeler's key, stores them in the log db, and serves them over
+// com.atproto.label.subscribeLabels and com.atproto.label.queryLabels, replacing the skyware labeler
+type Labeler struct {
+	did    string
+	key    atcrypto.PrivateKey
+	db     *gorm.DB
+	logger *slog.Logger
+
+	// held while a label is stored and handed to subscribers, so they always see sequence numbers in order
+	emitMu sync.Mutex
+	// lastSeq is the last label handed to subscribers
+	lastSeq uint
+
+	subsMu sync.Mutex
+	subs   map[*labelSubscriber]struct{}
+}
+
+type labelSubscriber struct {
+	ch   chan *SignedLabel
+	done chan struct{}
+	once sync.Once
+	// tooSlow is only safe to read once done is closed
+	tooSlow bool
+}
+
+func (s *labelSubscriber) close(tooSlow bool) {
+	s.once.Do(func() {
+		s.tooSlow = tooSlow
+		close(s.done)
+	})
+}
+
+func NewLabeler(db *gorm.DB, did string, key atcrypto.PrivateKey, logger *slog.Logger) (*Labeler, error) {
+	if !strings.HasPrefix(did, "did:") {
+		return nil, fmt.Errorf("bad labeler did %q", did)
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	lb := &Labeler{
+		did:    did,
+		key:    key,
+		db:     db,
+		logger: logger.With("component", "labeler"),
+		subs:   make(map[*labelSubscriber]struct{}),
+	}
+
+	// labels stored before now are only served from the db, to subscribers that ask for them with a cursor
+	if err := db.Model(&SignedLabel{}).Select("coalesce(max(id), 0)").Scan(&lb.lastSeq).Error; err != nil {
+		return nil, fmt.Errorf("failed to get latest label seq: %w", err)
+	}
+
+	return lb, nil
+}
+
+// ParseSigningKey reads a secp256k1 private key, either hex encoded as the skyware labeler expects it or multibase
+// encoded
+func ParseSigningKey(s string) (atcrypto.PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(s); err == nil {
+		key, err := atcrypto.ParsePrivateBytesK256(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signing key: %w", err)
+		}
+		return key, nil
+	}
+
+	key, err := atcrypto.ParsePrivateMultibase(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	return key, nil
+}
+
+func (lb *Labeler) Emit(ctx context.Context, uri, label string, exp *time.Time) error {
+	if !slices.Contains(AllLabels, label) && !slices.Contains(AccountLabels, label) {
+		return fmt.Errorf("invalid label %q", label)
+	}
+
+	_, err := lb.createLabel(ctx, uri, label, false, exp)
+	return err
+}
+
+func (lb *Labeler) Negate(ctx context.Context, uri, label string) error {
+	_, err := lb.createLabel(ctx, uri, label, true, nil)
+	return err
+}
+
+// createLabel signs a label, stores it and sends it to every subscriber
+func (lb *Labeler) createLabel(ctx context.Context, uri, val string, neg bool, exp *time.Time) (*SignedLabel, error) {
+	l := &SignedLabel{
+		Src: lb.did,
+		Uri: uri,
+		Val: val,
+		Neg: neg,
+		Cts: time.Now().UTC().Format(atprotoTime),
+	}
+	if exp != nil {
+		l.Exp = exp.UTC().Format(atprotoTime)
+	}
+	if err := lb.sign(l); err != nil {
+		return nil, err
+	}
+
+	lb.emitMu.Lock()
+	defer lb.emitMu.Unlock()
+
+	if err := lb.db.WithContext(ctx).Create(l).Error; err != nil {
+		return nil, fmt.Errorf("failed to store label: %w", err)
+	}
+
+	// other processes may have stored labels since the last poll, and they have lower ids than this one
+	lb.broadcastNewLocked()
+
+	return l, nil
+}
+
+// sign signs the DAG-CBOR encoding of the label without its signature
+func (lb *Labeler) sign(l *SignedLabel) error {
+	unsigned := l.lexicon()
+	unsigned.Sig = nil
+
+	var buf bytes.Buffer
+	if err := unsigned.MarshalCBOR(&buf); err != nil {
+		return fmt.Errorf("failed to encode label: %w", err)
+	}
+
+	sig, err := lb.key.HashAndSign(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to sign label: %w", err)
+	}
+	l.Sig = sig
+
+	return nil
+}
+
+func (lb *Labeler) broadcast(l *SignedLabel) {
+	lb.subsMu.Lock()
+	defer lb.subsMu.Unlock()
+
+	for sub := range lb.subs {
+		select {
+		case sub.ch <- l:
+		default:
+			sub.close(true)
+		}
+	}
+}
+
+func (lb *Labeler) subscribe() *labelSubscriber {
+	sub := &labelSubscriber{
+		ch:   make(chan *SignedLabel, labelSubscriberBuffer),
+		done: make(chan struct{}),
+	}
+
+	lb.subsMu.Lock()
+	lb.subs[sub] = struct{}{}
+	labelerSubscribers.Set(float64(len(lb.subs)))
+	lb.subsMu.Unlock()
+
+	return sub
+}
+
+func (lb *Labeler) unsubscribe(sub *labelSubscriber) {
+	lb.subsMu.Lock()
+	delete(lb.subs, sub)
+	labelerSubscribers.Set(float64(len(lb.subs)))
+	lb.subsMu.Unlock()
+}
+
+// pollLabels hands subscribers any labels created by other processes sharing the db, such as the negate command
+func (lb *Labeler) pollLabels(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		lb.emitMu.Lock()
+		lb.broadcastNewLocked()
+		lb.emitMu.Unlock()
+	}
+}
+
+// broadcastNewLocked sends every stored label after lastSeq to the subscribers, in id order. emitMu must be held
+func (lb *Labeler) broadcastNewLocked() {
+	var labels []SignedLabel
+	if err := lb.db.Where("id > ?", lb.lastSeq).Order("id").Find(&labels).Error; err != nil {
+		lb.logger.Error("failed to load new labels", "error", err)
+		return
+	}
+	for i := range labels {
+		lb.broadcast(&labels[i])
+		lb.lastSeq = labels[i].ID
+	}
+}
+
+// Start serves the labeler's xrpc endpoints on the given address
+func (lb *Labeler) Start(addr string) {
+	go lb.pollLabels(2 * time.Second)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/xrpc/com.atproto.label.subscribeLabels", lb.handleSubscribeLabels)
+	mux.HandleFunc("/xrpc/com.atproto.label.queryLabels", lb.handleQueryLabels)
+
+	go func() {
+		lb.logger.Info("starting labeler server", "addr", addr, "did", lb.did)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			lb.logger.Error("labeler server stopped", "error", err)
+		}
+	}()
+}
+
+var labelUpgrader = websocket.Upgrader{
+	// subscribeLabels is public, anyone may consume it
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// handleSubscribeLabels streams labels to a subscriber. With a cursor, every label after it is replayed from the db
+// before live labels are sent. Without one only live labels are sent.
+func (lb *Labeler) handleSubscribeLabels(w http.ResponseWriter, r *http.Request) {
+	cursor := int64(-1)
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		var err error
+		cursor, err = strconv.ParseInt(c, 10, 64)
+		if err != nil || cursor < 0 {
+			writeXrpcError(w, http.StatusBadRequest, "InvalidRequest", "cursor must be a non-negative integer")
+			return
+		}
+	}
+
+	conn, err := labelUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		lb.logger.Warn("failed to upgrade subscribeLabels connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	logger := lb.logger.With("remote", r.RemoteAddr, "cursor", cursor)
+	logger.Info("labels subscriber connected")
+	defer logger.Info("labels subscriber disconnected")
+
+	// subscribe before replaying so nothing created during the replay is missed. anything seen twice is skipped by seq
+	sub := lb.subscribe()
+	defer lb.unsubscribe(sub)
+
+	// nothing is expected from the subscriber, but reading is how a closed connection is noticed
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				sub.close(false)
+				return
+			}
+		}
+	}()
+
+	var last int64
+	if cursor >= 0 {
+		var latest int64
+		if err := lb.db.Model(&SignedLabel{}).Select("coalesce(max(id), 0)").Scan(&latest).Error; err != nil {
+			logger.Error("failed to get latest label seq", "error", err)
+			return
+		}
+		if cursor > latest {
+			writeErrorFrame(conn, "FutureCursor", "cursor is ahead of the latest label")
+			return
+		}
+
+		last = cursor
+		for {
+			var page []SignedLabel
+			if err := lb.db.Where("id > ?", last).Order("id").Limit(labelBackfillPage).Find(&page).Error; err != nil {
+				logger.Error("failed to load labels to replay", "error", err)
+				return
+			}
+			for i := range page {
+				if err := writeLabelFrame(conn, &page[i]); err != nil {
+					return
+				}
+				last = int64(page[i].ID)
+			}
+			if len(page) < labelBackfillPage {
+				break
+			}
+		}
+	}
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case l := <-sub.ch:
+			if int64(l.ID) <= last {
+				continue
+			}
+			if err := writeLabelFrame(conn, l); err != nil {
+				return
+			}
+			last = int64(l.ID)
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-sub.done:
+			if sub.tooSlow {
+				logger.Warn("labels subscriber fell too far behind, disconnecting")
+				writeErrorFrame(conn, "ConsumerTooSlow", "fell too far behind the stream")
+			}
+			return
+		}
+	}
+}
+
+// writeLabelFrame writes a #labels message, which is a DAG-CBOR header followed by the DAG-CBOR body
+func writeLabelFrame(conn *websocket.Conn, l *SignedLabel) error {
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	w, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+
+	header := events.EventHeader{Op: events.EvtKindMessage, MsgType: "#labels"}
+	if err := header.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	body := comatproto.LabelSubscribeLabels_Labels{
+		Seq:    int64(l.ID),
+		Labels: []*comatproto.LabelDefs_Label{l.lexicon()},
+	}
+	if err := body.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+func writeErrorFrame(conn *websocket.Conn, name, message string) {
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	w, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return
+	}
+
+	header := events.EventHeader{Op: events.EvtKindErrorFrame}
+	if err := header.MarshalCBOR(w); err != nil {
+		return
+	}
+	frame := events.ErrorFrame{Error: name, Message: message}
+	if err := frame.MarshalCBOR(w); err != nil {
+		return
+	}
+	w.Close()
+}
+
+// handleQueryLabels returns stored labels for uris matching any of the patterns. A pattern ending in * matches every
+// uri starting with the rest of it.
+func (lb *Labeler) handleQueryLabels(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	patterns := q["uriPatterns"]
+	if len(patterns) == 0 {
+		writeXrpcError(w, http.StatusBadRequest, "InvalidRequest", "uriPatterns is required")
+		return
+	}
+
+	limit := 50
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > 250 {
+			writeXrpcError(w, http.StatusBadRequest, "InvalidRequest", "limit must be between 1 and 250")
+			return
+		}
+		limit = n
+	}
+
+	var cursor int64
+	if c := q.Get("cursor"); c != "" {
+		n, err := strconv.ParseInt(c, 10, 64)
+		if err != nil {
+			writeXrpcError(w, http.StatusBadRequest, "InvalidRequest", "bad cursor")
+			return
+		}
+		cursor = n
+	}
+
+	out := comatproto.LabelQueryLabels_Output{
+		Labels: []*comatproto.LabelDefs_Label{},
+	}
+
+	// every label here comes from this labeler, so asking only for other sources finds nothing
+	if sources := q["sources"]; len(sources) > 0 && !slices.Contains(sources, lb.did) {
+		writeJson(w, out)
+		return
+	}
+
+	var conds []string
+	var args []any
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			conds = append(conds, `uri LIKE ? ESCAPE '\'`)
+			args = append(args, likeEscaper.Replace(prefix)+"%")
+		} else {
+			conds = append(conds, "uri = ?")
+			args = append(args, p)
+		}
+	}
+
+	var labels []SignedLabel
+	if err := lb.db.WithContext(r.Context()).
+		Where("id > ?", cursor).
+		Where("("+strings.Join(conds, " OR ")+")", args...).
+		Order("id").
+		Limit(limit).
+		Find(&labels).Error; err != nil {
+		lb.logger.Error("failed to query labels", "error", err)
+		writeXrpcError(w, http.StatusInternalServerError, "InternalServerError", "failed to query labels")
+		return
+	}
+
+	for i := range labels {
+		out.Labels = append(out.Labels, labels[i].lexicon())
+	}
+	if len(labels) == limit {
+		next := strconv.FormatUint(uint64(labels[len(labels)-1].ID), 10)
+		out.Cursor = &next
+	}
+
+	writeJson(w, out)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeXrpcError(w http.ResponseWriter, status int, name, message string) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": name, "message": message})
+}
@@ -6,6 +6,8 @@ const LABELS: Record<string, boolean> = {
   'bad-faith': true,
   'off-topic': true,
   funny: true,
+  'prompt-injection': true,
+  'repeat-bad-faith': true,
 }
 
 function run() {
@@ -48,7 +50,12 @@ function run() {
       return reply.send({error: 'unauthorized'})
     }
 
-    const body = request.body as {uri?: string; label?: string}
+    const body = request.body as {
+      uri?: string
+      label?: string
+      neg?: boolean
+      exp?: string
+    }
 
     if (!body.uri) {
       reply.statusCode = 400
@@ -68,6 +75,8 @@ function run() {
     await labelerServer.createLabel({
       uri: body.uri,
       val: body.label,
+      neg: body.neg === true,
+      exp: body.exp,
     })
 
     reply.statusCode = 200
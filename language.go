@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// languageNames are the languages we can name in prompts. anything else is still detected or declared, it just gets
+// the default prompt unless a custom one is configured
+var languageNames = map[string]string{
+	"ar": "Arabic",
+	"de": "German",
+	"el": "Greek",
+	"en": "English",
+	"es": "Spanish",
+	"fr": "French",
+	"he": "Hebrew",
+	"hi": "Hindi",
+	"it": "Italian",
+	"ja": "Japanese",
+	"ko": "Korean",
+	"nl": "Dutch",
+	"pt": "Portuguese",
+	"ru": "Russian",
+	"th": "Thai",
+	"uk": "Ukrainian",
+	"zh": "Chinese",
+}
+
+// common short words for telling apart languages written in the latin alphabet
+var latinStopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "you", "this", "that", "not", "with", "for", "what", "it's", "don't", "of"},
+	"pt": {"não", "que", "uma", "com", "você", "isso", "mas", "para", "é", "muito", "está", "então", "tá", "né"},
+	"es": {"que", "una", "con", "pero", "para", "está", "eso", "muy", "por", "qué", "y", "los", "las", "es"},
+	"fr": {"le", "les", "est", "une", "pas", "que", "et", "c'est", "pour", "avec", "vous", "tu", "je", "des"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "ich", "du", "mit", "auf", "zu", "sie"},
+	"it": {"il", "che", "non", "è", "una", "per", "con", "sono", "questo", "ma", "gli", "della", "anche", "perché"},
+	"nl": {"de", "het", "een", "en", "is", "niet", "van", "dat", "ik", "je", "met", "op", "maar", "zijn"},
+}
+
+// LanguageConfig decides how replies in each language are classified
+type LanguageConfig struct {
+	// Prompts are extra system prompt instructions per language, replacing the built in one
+	Prompts map[string]string
+	// TranslateTo is the language replies are translated to before classification, empty to never translate
+	TranslateTo string
+	// Skip holds the languages to ignore for each op. the "*" op applies to every op
+	Skip map[string][]string
+}
+
+// LoadLanguagePrompts reads a JSON object mapping language codes to system prompt instructions
+func LoadLanguagePrompts(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read language prompts: %w", err)
+	}
+
+	var raw map[string]string
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse language prompts: %w", err)
+	}
+
+	prompts := make(map[string]string, len(raw))
+	for lang, prompt := range raw {
+		prompts[baseLanguage(lang)] = strings.TrimSpace(prompt)
+	}
+	return prompts, nil
+}
+
+// ParseSkipLangs reads entries in the form did=lang, where did may be * to skip the language for every op
+func ParseSkipLangs(entries []string) (map[string][]string, error) {
+	skip := make(map[string][]string)
+	for _, e := range entries {
+		did, lang, ok := strings.Cut(e, "=")
+		if !ok || did == "" || lang == "" {
+			return nil, fmt.Errorf("bad skipped language %q, must be did=lang", e)
+		}
+		skip[did] = append(skip[did], lang)
+	}
+	return skip, nil
+}
+
+// Skips reports whether replies in the language should be ignored for the op
+func (c *LanguageConfig) Skips(opDid, lang string) bool {
+	if c == nil || lang == "" {
+		return false
+	}
+	matches := func(want string) bool { return langMatches(lang, want) }
+	return slices.ContainsFunc(c.Skip[opDid], matches) || slices.ContainsFunc(c.Skip["*"], matches)
+}
+
+// ShouldTranslate reports whether text in the language should be translated before classification
+func (c *LanguageConfig) ShouldTranslate(lang string) bool {
+	return c != nil && c.TranslateTo != "" && lang != "" && !langMatches(lang, c.TranslateTo)
+}
+
+// Prompt returns the extra system prompt instruction for posts in the language. translated posts get a note about
+// what may have been lost in translation instead.
+func (c *LanguageConfig) Prompt(lang string, translated bool) string {
+	if lang == "" {
+		return ""
+	}
+	name, ok := languageNames[lang]
+	if !ok {
+		name = "the language with the code \"" + lang + "\""
+	}
+
+	if translated {
+		return fmt.Sprintf("The posts were machine translated from %s, so tone, slang and wordplay may have been lost. Don't treat a reply as bad faith or off topic only because the translation reads oddly.", name)
+	}
+
+	if c != nil {
+		if prompt, ok := c.Prompts[lang]; ok {
+			return prompt
+		}
+	}
+	if lang == "en" {
+		return ""
+	}
+	return fmt.Sprintf("The posts are written in %s. Judge them by the norms of %s speakers, since slang, irony and politeness work differently than in English. Never penalize a reply for its language.", name, name)
+}
+
+// postLanguage is the first language the post declares, or the detected one if it declares none
+func postLanguage(langs []string, text string) string {
+	if len(langs) > 0 && langs[0] != "" {
+		return baseLanguage(langs[0])
+	}
+	return detectLanguage(text)
+}
+
+// baseLanguage lowercases a language tag and drops its region, so "pt-BR" becomes "pt"
+func baseLanguage(tag string) string {
+	lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+	return lang
+}
+
+// detectLanguage makes a rough guess from the scripts used in the text, and for the latin alphabet from common words.
+// it returns an empty string when it can't tell.
+func detectLanguage(text string) string {
+	counts := make(map[string]int)
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			counts["ja"]++
+		case unicode.Is(unicode.Hangul, r):
+			counts["ko"]++
+		case unicode.Is(unicode.Han, r):
+			counts["zh"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			counts["ru"]++
+		case unicode.Is(unicode.Arabic, r):
+			counts["ar"]++
+		case unicode.Is(unicode.Hebrew, r):
+			counts["he"]++
+		case unicode.Is(unicode.Thai, r):
+			counts["th"]++
+		case unicode.Is(unicode.Greek, r):
+			counts["el"]++
+		case unicode.Is(unicode.Devanagari, r):
+			counts["hi"]++
+		case unicode.Is(unicode.Latin, r):
+			counts["latin"]++
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+
+	// any kana means japanese, since japanese text mixes kana with han
+	if counts["ja"] > 0 {
+		return "ja"
+	}
+
+	best, bestCount := "", 0
+	for script, n := range counts {
+		if n > bestCount || (n == bestCount && script < best) {
+			best, bestCount = script, n
+		}
+	}
+	if best != "latin" {
+		return best
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	best, bestCount = "", 0
+	for lang, stopwords := range latinStopwords {
+		n := 0
+		for _, w := range words {
+			if slices.Contains(stopwords, w) {
+				n++
+			}
+		}
+		if n > bestCount || (n == bestCount && n > 0 && lang < best) {
+			best, bestCount = lang, n
+		}
+	}
+	// a single shared word is too weak to go on
+	if bestCount < 2 {
+		return ""
+	}
+	return best
+}
@@ -4,24 +4,87 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bluesky-social/indigo/pkg/robusthttp"
 )
 
 type LMStudioClient struct {
-	host             string
-	httpc            *http.Client
-	logger           *slog.Logger
-	modelName        string
+	name      string
+	host      string
+	httpc     *http.Client
+	logger    *slog.Logger
+	modelName string
+	// fallbackModel replaces modelName once the budget is reached, see BudgetFallbackModel
+	fallbackModel    string
 	endpointOverride string
 	apiKey           string
 	apiKeyType       string
+	maxRetries       int
+	cache            *ClassificationCache
+	limiter          *RateLimiter
+	usage            *UsageTracker
+	examples         *ExampleSelector
+	vision           bool
+	rationale        bool
+	// profile overrides the built in profile for the model, nil to look it up by model name
+	profile *ModelProfile
+
+	outputMode StructuredOutputMode
+	probeMu    sync.Mutex
+	probedMode StructuredOutputMode
+}
+
+type BackendConfig struct {
+	Name             string  `json:"name"`
+	Host             string  `json:"host"`
+	EndpointOverride string  `json:"endpoint_override"`
+	ApiKey           string  `json:"api_key"`
+	ApiKeyType       string  `json:"api_key_type"`
+	Model            string  `json:"model"`
+	Weight           float64 `json:"weight"`
+	MaxRetries       int     `json:"max_retries"`
+
+	RequestsPerMinute int `json:"requests_per_minute"`
+	TokensPerMinute   int `json:"tokens_per_minute"`
+	MaxInFlight       int `json:"max_in_flight"`
+
+	// Vision marks the model as able to look at images
+	Vision bool `json:"vision"`
+	// Rationale asks the model to explain each answer. the explanation is only ever stored in the log db
+	Rationale bool `json:"rationale"`
+
+	// Kind is either "completions" (the default) or "embeddings"
+	Kind string `json:"kind"`
+	// FirstPass members are asked before the rest of the ensemble, which is only asked if they all abstain
+	FirstPass bool `json:"first_pass"`
+
+	// K, MinSimilarity and LabelThreshold only apply to embeddings backends
+	K              int     `json:"k"`
+	MinSimilarity  float64 `json:"min_similarity"`
+	LabelThreshold float64 `json:"label_threshold"`
+
+	// Fallbacks are tried in order when this backend fails or its circuit breaker is open
+	Fallbacks []BackendConfig `json:"fallbacks"`
+
+	// Profile replaces the built in profile for the model, see profile.go
+	Profile *ModelProfile `json:"profile"`
+
+	// StructuredOutput is how the model is made to answer in JSON, see structured_mode.go
+	StructuredOutput StructuredOutputMode `json:"structured_output"`
+
+	// BudgetFallbackModel is the cheaper model this backend switches to once the budget is reached, when the budget
+	// action is "fallback". backends without one keep their model
+	BudgetFallbackModel string `json:"budget_fallback_model"`
 }
+
 type ResponseSchema struct {
 	Type       string              `json:"type"`
 	Properties map[string]Property `json:"properties"`
@@ -29,9 +92,12 @@ type ResponseSchema struct {
 }
 
 type Property struct {
-	Type        string   `json:"type"`
-	Description string   `json:"description,omitempty"`
-	Enum        []string `json:"enum,omitempty"`
+	Type        string              `json:"type"`
+	Description string              `json:"description,omitempty"`
+	Enum        []string            `json:"enum,omitempty"`
+	Items       *Property           `json:"items,omitempty"`
+	Properties  map[string]Property `json:"properties,omitempty"`
+	Required    []string            `json:"required,omitempty"`
 }
 
 type ChatRequest struct {
@@ -40,11 +106,58 @@ type ChatRequest struct {
 	Temperature    float64         `json:"temperature,omitempty"`
 	MaxTokens      int             `json:"max_tokens,omitempty"`
 	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	// MaxCompletionTokens replaces MaxTokens for models whose profile asks for it
+	MaxCompletionTokens int `json:"max_completion_tokens,omitempty"`
+
+	Tools      []Tool `json:"tools,omitempty"`
+	ToolChoice any    `json:"tool_choice,omitempty"`
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role string `json:"role"`
+	// Content is either a plain string, or a list of ContentParts for requests that include images
+	Content any `json:"content"`
+	// ReasoningContent is the thinking of reasoning models, on servers that return it separately from the answer
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+	// ToolCalls holds the model's answer when it is made to answer with a tool call
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+// reasoning returns the model's thinking, either from the separate field or from think blocks left in the content
+func (m Message) reasoning() string {
+	if m.ReasoningContent != "" {
+		return strings.TrimSpace(m.ReasoningContent)
+	}
+	return thinkContent(m.Text())
+}
+
+// Text returns the text of the message, joining the text parts if the content is a list
+func (m Message) Text() string {
+	switch c := m.Content.(type) {
+	case string:
+		return c
+	case []any:
+		var sb strings.Builder
+		for _, p := range c {
+			if part, ok := p.(map[string]any); ok {
+				if text, ok := part["text"].(string); ok {
+					sb.WriteString(text)
+				}
+			}
+		}
+		return sb.String()
+	}
+	return ""
 }
 
 type ResponseFormat struct {
@@ -64,6 +177,7 @@ type ChatResponse struct {
 	Created int64    `json:"created"`
 	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
 }
 
 type Choice struct {
@@ -72,44 +186,78 @@ type Choice struct {
 	FinishReason string  `json:"finish_reason"`
 }
 
-var (
-	schema = ResponseSchema{
-		Type: "object",
-		Properties: map[string]Property{
-			"bad_faith": {
-				Type:        "boolean",
-				Description: "Whether the reply to the parent is bad faith or not.",
-			},
-			"off_topic": {
-				Type:        "boolean",
-				Description: "Whether the reply to the parent is off topic.",
-			},
-			"funny": {
-				Type:        "boolean",
-				Description: "Whether the reply to the parent is funny.",
-			},
-		},
-		Required: []string{"bad_faith", "off_topic", "funny"},
-	}
-)
-
-func NewLMStudioClient(host string, endpointOverride string, apiKey string, apiKeyType string, modelName string, logger *slog.Logger) *LMStudioClient {
+func NewLMStudioClient(config BackendConfig, cache *ClassificationCache, usage *UsageTracker, examples *ExampleSelector, logger *slog.Logger) *LMStudioClient {
 	if logger == nil {
 		logger = slog.Default()
 	}
-	logger = logger.With("component", "lmstudio")
+	name := config.Name
+	if name == "" {
+		name = config.Model
+	}
+	maxRetries := max(config.MaxRetries, 0)
+	outputMode := config.StructuredOutput
+	if outputMode == "" {
+		outputMode = StructuredOutputJSONSchema
+	}
+	logger = logger.With("component", "lmstudio", "backend", name)
 	httpc := robusthttp.NewClient()
 	return &LMStudioClient{
-		host:             host,
+		name:             name,
+		host:             config.Host,
 		httpc:            httpc,
 		logger:           logger,
-		modelName:        modelName,
-		endpointOverride: endpointOverride,
-		apiKey:           apiKey,
-		apiKeyType:       apiKeyType,
+		modelName:        config.Model,
+		fallbackModel:    config.BudgetFallbackModel,
+		endpointOverride: config.EndpointOverride,
+		apiKey:           config.ApiKey,
+		apiKeyType:       config.ApiKeyType,
+		maxRetries:       maxRetries,
+		cache:            cache,
+		limiter:          NewRateLimiter(name, config.RequestsPerMinute, config.TokensPerMinute, config.MaxInFlight),
+		usage:            usage,
+		examples:         examples,
+		vision:           config.Vision,
+		rationale:        config.Rationale,
+		profile:          config.Profile,
+		outputMode:       outputMode,
 	}
 }
 
+func (c *LMStudioClient) Name() string {
+	return c.name
+}
+
+// currentModel is the configured model, unless the budget has been reached and the backend has a cheaper fallback
+func (c *LMStudioClient) currentModel() string {
+	if c.fallbackModel != "" && c.usage != nil && c.usage.UseFallback() {
+		return c.fallbackModel
+	}
+	return c.modelName
+}
+
+// currentProfile is the configured profile, or the built in one for the model currently in use
+func (c *LMStudioClient) currentProfile() *ModelProfile {
+	if c.profile != nil {
+		return c.profile
+	}
+	profile := ProfileForModel(c.currentModel())
+	return &profile
+}
+
+// newRequest builds a request for the current model, asking for an answer in the given schema with the structured
+// output mode the server supports. maxTokens is the budget for the answer alone, the profile adds room for thinking and
+// drops anything the model doesn't support.
+func (c *LMStudioClient) newRequest(ctx context.Context, messages []Message, maxTokens int, schemaName string, schema ResponseSchema) ChatRequest {
+	request := ChatRequest{
+		Model:       c.currentModel(),
+		Messages:    messages,
+		Temperature: 0.7,
+	}
+	request.setStructuredOutput(c.structuredOutputMode(ctx), schemaName, schema)
+	c.currentProfile().applyTo(&request, maxTokens)
+	return request
+}
+
 func (c *LMStudioClient) sendChatRequest(ctx context.Context, request ChatRequest) (*ChatResponse, error) {
 	host := c.host
 	endpoint := "/v1/chat/completions"
@@ -124,6 +272,15 @@ func (c *LMStudioClient) sendChatRequest(ctx context.Context, request ChatReques
 		return nil, fmt.Errorf("error marshaling request: %w", err)
 	}
 
+	release, err := c.limiter.Acquire(ctx, estimatePromptTokens(request, len(b))+request.MaxTokens+request.MaxCompletionTokens)
+	if err != nil {
+		return nil, permanentError(fmt.Errorf("gave up waiting for rate limiter: %w", err))
+	}
+	var usedTokens int
+	defer func() {
+		release(usedTokens)
+	}()
+
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %w", err)
@@ -131,105 +288,367 @@ func (c *LMStudioClient) sendChatRequest(ctx context.Context, request ChatReques
 
 	req.Header.Set("content-type", "application/json")
 	req.Header.Set("accept", "application/json")
-	if c.apiKey != "" {
-		if c.apiKeyType == "bearer" {
-			req.Header.Set("authorization", "Bearer "+c.apiKey)
-		} else if c.apiKeyType == "x-api-key" {
-			req.Header.Set("x-api-key", c.apiKey)
-		}
-	}
+	setApiKey(req, c.apiKey, c.apiKeyType)
 
 	resp, err := c.httpc.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error sending request: %w", err)
+		if ctx.Err() != nil {
+			return nil, permanentError(fmt.Errorf("error sending request: %w", err))
+		}
+		return nil, retryableError(fmt.Errorf("error sending request: %w", err))
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response: %w", err)
+		return nil, retryableError(fmt.Errorf("error reading response: %w", err))
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status code: %d - %s", resp.StatusCode, string(body))
+		err := fmt.Errorf("bad status code: %d - %s", resp.StatusCode, string(body))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			retryAfter := parseRetryAfter(resp.Header)
+			if retryAfter > 0 {
+				c.logger.Warn("completions api is rate limiting us, pausing requests", "retryAfter", retryAfter)
+				c.limiter.Pause(retryAfter)
+			}
+			return nil, &ClassificationError{Err: err, Retryable: true, RetryAfter: retryAfter, StatusCode: resp.StatusCode}
+		}
+		return nil, &ClassificationError{Err: err, Retryable: resp.StatusCode >= 500, StatusCode: resp.StatusCode}
 	}
 
 	var chatResp ChatResponse
 	if err := json.Unmarshal(body, &chatResp); err != nil {
-		return nil, fmt.Errorf("error unmarshaling response: %w", err)
+		return nil, retryableError(fmt.Errorf("error unmarshaling response: %w", err))
+	}
+
+	if chatResp.Usage != nil {
+		usedTokens = chatResp.Usage.Total()
+		if c.usage != nil {
+			c.usage.Record(ctx, c.name, request.Model, chatResp.Usage)
+		}
+	}
+
+	if len(chatResp.Choices) == 0 {
+		return nil, retryableError(fmt.Errorf("response contained no choices"))
 	}
 
 	return &chatResp, nil
 }
 
+func setApiKey(req *http.Request, apiKey, apiKeyType string) {
+	if apiKey == "" {
+		return
+	}
+	if apiKeyType == "bearer" {
+		req.Header.Set("authorization", "Bearer "+apiKey)
+	} else if apiKeyType == "x-api-key" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+}
+
 type BadFaithResults struct {
-	BadFaith bool
-	OffTopic bool
-	Funny    bool
+	BadFaith        bool
+	OffTopic        bool
+	Funny           bool
+	PromptInjection bool
+
+	// Rationale is the model's short explanation, and Reasoning its thinking. both are only ever stored in the log db
+	Rationale string
+	Reasoning string
+
+	// Backend is the name of the backend that produced the results
+	Backend string
 }
 
-func (c *LMStudioClient) GetIsBadFaith(ctx context.Context, parent, reply string) (*BadFaithResults, error) {
-	request := ChatRequest{
-		Model: c.modelName,
-		Messages: []Message{
-			{
-				Role:    "system",
-				Content: "You are an observer of posts on a microblogging website. You determine if the second message provided by the user is a bad faith reply, an off topic reply, and/or a funny reply to the second message provided to you. Opposing viewpoints are good, and should be appreciated. However, things that are toxic, trollish, or offer no good value to the conversation are considered bad faith. Just because something is bad faith or off topic does not mean the post cannot also be funny. Always respond with pure JSON. The structure should be {bad_faith: boolean, off_topic: boolean, funny: boolean}. Never include additional context about why you made a choice, only the raw JSON.",
-			},
-			{
-				Role:    "user",
-				Content: parent,
-			},
-			{
+func (r *BadFaithResults) Has(label string) bool {
+	switch label {
+	case LabelBadFaith:
+		return r.BadFaith
+	case LabelOffTopic:
+		return r.OffTopic
+	case LabelFunny:
+		return r.Funny
+	case LabelPromptInjection:
+		return r.PromptInjection
+	}
+	return false
+}
+
+func (r *BadFaithResults) Set(label string, v bool) {
+	switch label {
+	case LabelBadFaith:
+		r.BadFaith = v
+	case LabelOffTopic:
+		r.OffTopic = v
+	case LabelFunny:
+		r.Funny = v
+	case LabelPromptInjection:
+		r.PromptInjection = v
+	}
+}
+
+func (r *BadFaithResults) Labels() []string {
+	labels := []string{}
+	for _, l := range AllLabels {
+		if r.Has(l) {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+// imageTokens is roughly what an image costs in prompt tokens once downscaled. Providers bill images by their size,
+// not by the length of the base64 they were sent as
+const imageTokens = 1000
+
+// estimatePromptTokens guesses the prompt tokens of a request marshaled to size bytes, at roughly four bytes per token
+// for text and a fixed cost per image
+func estimatePromptTokens(request ChatRequest, size int) int {
+	var images int
+	for _, m := range request.Messages {
+		parts, ok := m.Content.([]ContentPart)
+		if !ok {
+			continue
+		}
+		for _, p := range parts {
+			if p.ImageURL != nil {
+				size -= len(p.ImageURL.URL)
+				images++
+			}
+		}
+	}
+	return max(size, 0)/4 + images*imageTokens
+}
+
+// postMessage renders a post as a user message inside the given tag, attaching its images when the backend can see them
+func (c *LMStudioClient) postMessage(tag string, post *PostContent) Message {
+	text := wrapUntrusted(tag, post.Render())
+	if !c.vision || len(post.Images) == 0 {
+		return Message{
+			Role:    "user",
+			Content: text,
+		}
+	}
+
+	parts := []ContentPart{{Type: "text", Text: text}}
+	for _, img := range post.Images {
+		parts = append(parts, ContentPart{
+			Type:     "image_url",
+			ImageURL: &ImageURL{URL: img.DataURL()},
+		})
+	}
+
+	return Message{
+		Role:    "user",
+		Content: parts,
+	}
+}
+
+// prompt is the system prompt and schema for a single reply
+func (c *LMStudioClient) prompt() *ClassificationPrompt {
+	if c.rationale {
+		return rationalePrompt
+	}
+	return defaultPrompt
+}
+
+// batchPrompt is the system prompt and schema for a batch of replies
+func (c *LMStudioClient) batchPrompt() *ClassificationPrompt {
+	if c.rationale {
+		return batchRationalePrompt
+	}
+	return batchPrompt
+}
+
+// maxTokens is the answer budget for the given number of replies, leaving room for the rationale when one is asked for
+func (c *LMStudioClient) maxTokens(replies int) int {
+	perReply := c.currentProfile().AnswerTokens
+	if perReply == 0 {
+		perReply = 50
+		if c.rationale {
+			perReply = 150
+		}
+	}
+	return perReply * replies
+}
+
+func (c *LMStudioClient) GetIsBadFaith(ctx context.Context, input *ClassificationInput) (*BadFaithResults, error) {
+	prompt := c.prompt().withInstruction(input.LangPrompt)
+
+	cacheKey, results, ok := c.cachedResults(ctx, input)
+	if ok {
+		return results, nil
+	}
+
+	messages := []Message{
+		{
+			Role:    "system",
+			Content: prompt.System,
+		},
+	}
+	messages = append(messages, exampleMessages(c.examples.Select(ctx, input, c.rationale), c.rationale)...)
+	if thread := renderAncestry(input.Ancestors); thread != "" {
+		messages = append(messages, Message{
+			Role:    "user",
+			Content: thread,
+		})
+	}
+	if replier := input.Replier.Render(); replier != "" {
+		messages = append(messages, Message{
+			Role:    "user",
+			Content: replier,
+		})
+	}
+	messages = append(messages, c.postMessage("parent", &input.Parent), c.postMessage("reply", &input.Reply))
+
+	request := c.newRequest(ctx, messages, c.maxTokens(2), "message_classification", prompt.Schema)
+
+	result, reasoning, err := c.completeStructured(ctx, request, prompt.Schema, prompt.Shape, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	results = resultsFromObject(result, c.name)
+	results.Reasoning = reasoning
+
+	c.storeResults(ctx, cacheKey, results)
+
+	return results, nil
+}
+
+// exampleMessages shows each example as a user message holding the post and reply, answered by an assistant message
+func exampleMessages(examples []*FewShotExample, rationale bool) []Message {
+	messages := make([]Message, 0, 2*len(examples))
+	for _, ex := range examples {
+		answer, _ := json.Marshal(ex.answer(rationale))
+		messages = append(messages,
+			Message{
 				Role:    "user",
-				Content: reply,
+				Content: "[example]\n" + wrapUntrusted("parent", ex.Parent) + "\n" + wrapUntrusted("reply", ex.Reply),
 			},
-		},
-		Temperature: 0.7,
-		MaxTokens:   100,
-		ResponseFormat: &ResponseFormat{
-			Type: "json_schema",
-			JSONSchema: &JSONSchemaWrap{
-				Name:   "message_classification",
-				Schema: schema,
-				Strict: true,
+			Message{
+				Role:    "assistant",
+				Content: string(answer),
 			},
-		},
+		)
 	}
-	response, err := c.sendChatRequest(ctx, request)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get chat response: %w", err)
+	return messages
+}
+
+func (r *BadFaithResults) object() map[string]any {
+	return map[string]any{
+		"bad_faith":        r.BadFaith,
+		"off_topic":        r.OffTopic,
+		"funny":            r.Funny,
+		"prompt_injection": r.PromptInjection,
 	}
+}
 
-	rawJson := response.Choices[0].Message.Content
-	if after, ok := strings.CutPrefix(rawJson, "```json"); ok {
-		rawJson = after
-		rawJson = strings.TrimSuffix(rawJson, "```")
+func resultsFromObject(obj map[string]any, backend string) *BadFaithResults {
+	rationale, _ := obj["rationale"].(string)
+	return &BadFaithResults{
+		BadFaith:        obj["bad_faith"].(bool),
+		OffTopic:        obj["off_topic"].(bool),
+		Funny:           obj["funny"].(bool),
+		PromptInjection: obj["prompt_injection"].(bool),
+		Rationale:       rationale,
+		Backend:         backend,
 	}
+}
+
+// resultsCacheKey identifies the answer for the input. Replies classified on their own and in a batch share it, the
+// prompts differ only in how the replies are laid out, so it is always versioned by the single reply prompt.
+func (c *LMStudioClient) resultsCacheKey(ctx context.Context, input *ClassificationInput) string {
+	version := c.prompt().withInstruction(input.LangPrompt).Version
+	return classificationCacheKey(renderAncestry(input.Ancestors), input.Replier.Render(), input.Parent.key(c.vision), input.Reply.key(c.vision), c.examples.Version(ctx), c.currentModel(), version)
+}
 
-	var result map[string]any
-	if err := json.Unmarshal([]byte(rawJson), &result); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %w %+v", err, response)
+// cachedResults looks up a previous result for the input. The returned key should be handed to storeResults once a
+// fresh result is available.
+func (c *LMStudioClient) cachedResults(ctx context.Context, input *ClassificationInput) (string, *BadFaithResults, bool) {
+	if c.cache == nil {
+		return "", nil, false
 	}
 
-	badFaith, ok := result["bad_faith"].(bool)
-	if !ok {
-		return nil, fmt.Errorf("model gave bad response (bad faith), not structured")
+	cacheKey := c.resultsCacheKey(ctx, input)
+	if results, ok := c.cache.Get(ctx, cacheKey); ok {
+		cacheHits.WithLabelValues(c.name).Inc()
+		results.Backend = c.name
+		return cacheKey, results, true
 	}
+	cacheMisses.WithLabelValues(c.name).Inc()
 
-	offTopic, ok := result["off_topic"].(bool)
-	if !ok {
-		return nil, fmt.Errorf("model gave bad response (off topic), not structured")
+	return cacheKey, nil, false
+}
+
+func (c *LMStudioClient) storeResults(ctx context.Context, cacheKey string, results *BadFaithResults) {
+	if c.cache == nil || cacheKey == "" {
+		return
 	}
+	c.cache.Put(ctx, cacheKey, c.currentModel(), results)
+}
 
-	funny, ok := result["funny"].(bool)
-	if !ok {
-		return nil, fmt.Errorf("model gave bad response (funny), not structured")
+// completeStructured sends the request and validates the answer against the schema, plus the optional check. Retryable
+// transport errors are retried with backoff, and invalid answers are sent back to the model along with what was wrong
+// with them. shape is a short description of the expected JSON used in the repair message.
+func (c *LMStudioClient) completeStructured(ctx context.Context, request ChatRequest, schema ResponseSchema, shape string, check func(map[string]any) error) (map[string]any, string, error) {
+	var lastErr error
+	var backoff time.Duration
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		// repair attempts go out immediately, transport failures back off before trying again
+		if backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, "", fmt.Errorf("gave up after %d attempts: %w", attempt, lastErr)
+			case <-time.After(backoff):
+			}
+		}
+
+		response, err := c.sendChatRequest(ctx, request)
+		if err != nil {
+			if !IsRetryable(err) {
+				return nil, "", fmt.Errorf("failed to get chat response: %w", err)
+			}
+			c.logger.Warn("retryable error from completions api", "attempt", attempt+1, "error", err)
+			lastErr = err
+			backoff = min(max(backoff*2, time.Second), 8*time.Second)
+			var cerr *ClassificationError
+			if errors.As(err, &cerr) && cerr.RetryAfter > backoff {
+				backoff = cerr.RetryAfter
+			}
+			continue
+		}
+
+		choice := response.Choices[0]
+		content := answerText(choice.Message)
+		result, err := parseStructuredOutput(content, schema)
+		if err != nil && choice.FinishReason == "length" && c.currentProfile().thinks() {
+			c.logger.Warn("model ran out of tokens before answering, consider raising reasoning_tokens in its profile", "maxTokens", request.MaxTokens+request.MaxCompletionTokens)
+		}
+		if err == nil && check != nil {
+			err = check(result)
+		}
+		if err != nil {
+			c.logger.Warn("model gave invalid structured output, asking it to repair", "attempt", attempt+1, "error", err)
+			lastErr = retryableError(err)
+			backoff = 0
+			// feed the bad answer and what was wrong with it back so the next attempt can fix it
+			request.Messages = append(request.Messages,
+				Message{
+					Role:    "assistant",
+					Content: content,
+				},
+				Message{
+					Role:    "user",
+					Content: fmt.Sprintf("That response was rejected: %s. Respond again with only the raw JSON object %s and nothing else.", err, shape),
+				},
+			)
+			continue
+		}
+
+		return result, c.currentProfile().reasoning(choice.Message), nil
 	}
 
-	return &BadFaithResults{
-		BadFaith: badFaith,
-		OffTopic: offTopic,
-		Funny:    funny,
-	}, nil
+	return nil, "", fmt.Errorf("gave up after %d attempts: %w", c.maxRetries+1, lastErr)
 }
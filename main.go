@@ -1,11 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"log/slog"
 	"net/http"
@@ -13,9 +11,11 @@ import (
 	"time"
 
 	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/util"
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/bluesky-social/jetstream/pkg/client"
+	"github.com/bluesky-social/jetstream/pkg/client/schedulers/parallel"
 	"github.com/bluesky-social/jetstream/pkg/client/schedulers/sequential"
 	"github.com/bluesky-social/jetstream/pkg/models"
 	lru "github.com/hashicorp/golang-lru/v2/expirable"
@@ -29,37 +29,63 @@ const (
 	LabelBadFaith = "bad-faith"
 	LabelOffTopic = "off-topic"
 	LabelFunny    = "funny"
+	// the reply tries to instruct or manipulate the classifier
+	LabelPromptInjection = "prompt-injection"
+
+	// put on the account of an author who wrote too many bad faith replies recently
+	LabelRepeatBadFaith = "repeat-bad-faith"
+
+	LabelNoLabels     = "no-labels"
+	LabelUnclassified = "unclassified"
 )
 
+var AllLabels = []string{LabelBadFaith, LabelOffTopic, LabelFunny, LabelPromptInjection}
+
+// AccountLabels go on accounts rather than posts, and are never decided by the classifiers
+var AccountLabels = []string{LabelRepeatBadFaith}
+
 func main() {
 	app := &cli.App{
 		Name:   "dontshowmethis",
 		Action: run,
+		Commands: []*cli.Command{
+			spendCommand,
+			reviewCommand,
+			negateCommand,
+			outboxCommand,
+			shadowCommand,
+		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:     "pds-url",
-				EnvVars:  []string{"PDS_URL"},
-				Required: true,
+				Name:    "pds-url",
+				EnvVars: []string{"PDS_URL"},
 			},
 			&cli.StringFlag{
-				Name:     "account-handle",
-				EnvVars:  []string{"ACCOUNT_HANDLE"},
-				Required: true,
+				Name:    "account-handle",
+				EnvVars: []string{"ACCOUNT_HANDLE"},
 			},
 			&cli.StringFlag{
-				Name:     "account-password",
-				EnvVars:  []string{"ACCOUNT_PASSWORD"},
-				Required: true,
+				Name:    "account-password",
+				EnvVars: []string{"ACCOUNT_PASSWORD"},
 			},
 			&cli.StringSliceFlag{
-				Name:     "watched-ops",
-				EnvVars:  []string{"WATCHED_OPS"},
-				Required: true,
+				Name:    "watched-ops",
+				EnvVars: []string{"WATCHED_OPS"},
 			},
 			&cli.StringSliceFlag{
 				Name:    "watched-log-ops",
 				EnvVars: []string{"WATCHED_LOG_OPS"},
 			},
+			&cli.StringSliceFlag{
+				Name:    "shadow-ops",
+				Usage:   "ops to classify replies to and record the labels that would have been emitted, without emitting them",
+				EnvVars: []string{"SHADOW_OPS"},
+			},
+			&cli.BoolFlag{
+				Name:    "shadow",
+				Usage:   "record labels for every watched op instead of emitting them",
+				EnvVars: []string{"SHADOW_MODE"},
+			},
 			&cli.StringSliceFlag{
 				Name:    "logged-labels",
 				EnvVars: []string{"LOGGED_LABELS"},
@@ -70,22 +96,41 @@ func main() {
 				Value:   "wss://jetstream2.us-west.bsky.network/subscribe",
 			},
 			&cli.StringFlag{
-				Name:     "labeler-url",
-				Usage:    "skyware labeler event emission url",
-				Required: true,
-				EnvVars:  []string{"LABELER_URL"},
+				Name:    "labeler-mode",
+				Usage:   "either \"remote\" to send labels to the skyware labeler, or \"local\" to sign and serve them from this process",
+				EnvVars: []string{"LABELER_MODE"},
+				Value:   LabelerModeRemote,
+			},
+			&cli.StringFlag{
+				Name:    "labeler-url",
+				Usage:   "skyware labeler event emission url. required in remote mode",
+				EnvVars: []string{"LABELER_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "labeler-key",
+				Usage:   "skyware labeler event emission key. required in remote mode",
+				EnvVars: []string{"LABELER_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "labeler-did",
+				Usage:   "did of the labeler account. required in local mode",
+				EnvVars: []string{"LABELER_DID", "SKYWARE_DID"},
 			},
 			&cli.StringFlag{
-				Name:     "labeler-key",
-				Usage:    "skyware labeler event emission key",
-				Required: true,
-				EnvVars:  []string{"LABELER_KEY"},
+				Name:    "labeler-signing-key",
+				Usage:   "hex or multibase encoded secp256k1 private key labels are signed with. required in local mode",
+				EnvVars: []string{"LABELER_SIGNING_KEY", "SKYWARE_SIG_KEY"},
 			},
 			&cli.StringFlag{
-				Name:     "completions-api-host",
-				Usage:    "host for the completions api you are using. starts with https:// and has no trailing slash or endpoint",
-				EnvVars:  []string{"COMPLETIONS_API_HOST", "LMSTUDIO_HOST"},
-				Required: true,
+				Name:    "labeler-listen-addr",
+				Usage:   "address the local labeler serves subscribeLabels and queryLabels on",
+				EnvVars: []string{"LABELER_LISTEN_ADDR"},
+				Value:   ":14831",
+			},
+			&cli.StringFlag{
+				Name:    "completions-api-host",
+				Usage:   "host for the completions api you are using. starts with https:// and has no trailing slash or endpoint",
+				EnvVars: []string{"COMPLETIONS_API_HOST", "LMSTUDIO_HOST"},
 			},
 			&cli.StringFlag{
 				Name:    "endpoint-override",
@@ -103,6 +148,17 @@ func main() {
 				EnvVars: []string{"MODEL_NAME"},
 				Value:   "google/gemma-3-27b",
 			},
+			&cli.StringFlag{
+				Name:    "structured-output",
+				Usage:   "how to make the model answer in JSON. one of \"json_schema\", \"json_object\", \"tools\", \"none\", or \"auto\" to probe the server once and use the best mode it supports",
+				EnvVars: []string{"STRUCTURED_OUTPUT"},
+				Value:   string(StructuredOutputJSONSchema),
+			},
+			&cli.StringFlag{
+				Name:    "model-profile",
+				Usage:   "path to a JSON model profile describing the token budget, reasoning format and supported request fields of MODEL_NAME. replaces the built in profile",
+				EnvVars: []string{"MODEL_PROFILE"},
+			},
 			&cli.StringFlag{
 				Name:    "completions-api-key",
 				Aliases: []string{"api-key"},
@@ -115,6 +171,224 @@ func main() {
 				Usage:   "api key type. either \"bearer\" or \"x-api-key\"",
 				EnvVars: []string{"COMPLETIONS_API_KEY_TYPE"},
 			},
+			&cli.IntFlag{
+				Name:    "completions-max-retries",
+				Usage:   "how many times to retry a classification after a retryable error or invalid structured output",
+				EnvVars: []string{"COMPLETIONS_MAX_RETRIES"},
+				Value:   2,
+			},
+			&cli.IntFlag{
+				Name:    "completions-requests-per-minute",
+				Usage:   "most requests to send to the completions api per minute. 0 for no limit",
+				EnvVars: []string{"COMPLETIONS_REQUESTS_PER_MINUTE"},
+			},
+			&cli.IntFlag{
+				Name:    "completions-tokens-per-minute",
+				Usage:   "most tokens (estimated before the request, corrected after) to send to the completions api per minute. 0 for no limit",
+				EnvVars: []string{"COMPLETIONS_TOKENS_PER_MINUTE"},
+			},
+			&cli.IntFlag{
+				Name:    "completions-max-in-flight",
+				Usage:   "most requests to have in flight to the completions api at once. 0 for no limit",
+				EnvVars: []string{"COMPLETIONS_MAX_IN_FLIGHT"},
+			},
+			&cli.BoolFlag{
+				Name:    "completions-vision",
+				Usage:   "the model can look at images. images attached to replies and parents are downloaded and sent along with the text",
+				EnvVars: []string{"COMPLETIONS_VISION"},
+			},
+			&cli.Int64Flag{
+				Name:    "image-max-bytes",
+				Usage:   "skip images bigger than this many bytes. 0 for no limit",
+				EnvVars: []string{"IMAGE_MAX_BYTES"},
+				Value:   1_000_000,
+			},
+			&cli.IntFlag{
+				Name:    "image-max-dimension",
+				Usage:   "downscale images so their longest side is at most this many pixels. 0 to send them at full size",
+				EnvVars: []string{"IMAGE_MAX_DIMENSION"},
+				Value:   1024,
+			},
+			&cli.IntFlag{
+				Name:    "thread-context-depth",
+				Usage:   "how many posts above the parent to include as thread context. 0 to only include the parent",
+				EnvVars: []string{"THREAD_CONTEXT_DEPTH"},
+			},
+			&cli.IntFlag{
+				Name:    "thread-context-tokens",
+				Usage:   "rough token budget for thread context. older posts past the budget are left out. 0 for no budget",
+				EnvVars: []string{"THREAD_CONTEXT_TOKENS"},
+				Value:   1000,
+			},
+			&cli.BoolFlag{
+				Name:    "replier-context",
+				Usage:   "look up whether the replier and op follow each other, the replier's account age and post count, and their label history, and include it in the prompt",
+				EnvVars: []string{"REPLIER_CONTEXT"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "model-pricing",
+				Usage:   "price of each model in USD per million tokens, as model=input:output. used for cost accounting and budgets",
+				EnvVars: []string{"MODEL_PRICING"},
+			},
+			&cli.Float64Flag{
+				Name:    "daily-budget",
+				Usage:   "most to spend on the completions api per UTC day, in USD. 0 for no cap",
+				EnvVars: []string{"DAILY_BUDGET"},
+			},
+			&cli.Float64Flag{
+				Name:    "monthly-budget",
+				Usage:   "most to spend on the completions api per UTC month, in USD. 0 for no cap",
+				EnvVars: []string{"MONTHLY_BUDGET"},
+			},
+			&cli.StringFlag{
+				Name:    "budget-action",
+				Usage:   "what to do once a budget is reached. either \"log-only\" or \"fallback\"",
+				EnvVars: []string{"BUDGET_ACTION"},
+				Value:   string(BudgetActionLogOnly),
+			},
+			&cli.StringFlag{
+				Name:    "budget-fallback-model",
+				Usage:   "cheaper model to switch to once a budget is reached, when the budget action is \"fallback\". with a classifiers config, set budget_fallback_model per backend instead",
+				EnvVars: []string{"BUDGET_FALLBACK_MODEL"},
+			},
+			&cli.DurationFlag{
+				Name:    "classification-cache-ttl",
+				Usage:   "how long to reuse a result for an identical parent and reply. stored in the log db, set to 0 to disable",
+				EnvVars: []string{"CLASSIFICATION_CACHE_TTL"},
+				Value:   24 * time.Hour,
+			},
+			&cli.StringFlag{
+				Name:    "metrics-listen-addr",
+				Usage:   "address to serve prometheus metrics on, e.g. :8080. metrics are not served if empty",
+				EnvVars: []string{"METRICS_LISTEN_ADDR"},
+			},
+			&cli.IntFlag{
+				Name:    "max-concurrent-events",
+				Usage:   "how many jetstream events to handle at once. events from the same repo are always handled in order",
+				EnvVars: []string{"MAX_CONCURRENT_EVENTS"},
+				Value:   1,
+			},
+			&cli.DurationFlag{
+				Name:    "batch-window",
+				Usage:   "how long to collect replies to the same parent before classifying them in one request. set to 0 to disable batching",
+				EnvVars: []string{"BATCH_WINDOW"},
+			},
+			&cli.IntFlag{
+				Name:    "batch-max-size",
+				Usage:   "the most replies to classify in a single batched request",
+				EnvVars: []string{"BATCH_MAX_SIZE"},
+				Value:   8,
+			},
+			&cli.StringFlag{
+				Name:    "classifiers-config",
+				Usage:   "path to a json file describing multiple classifier backends and how to combine their votes. overrides the single completions api flags",
+				EnvVars: []string{"CLASSIFIERS_CONFIG"},
+			},
+			&cli.BoolFlag{
+				Name:    "completions-rationale",
+				Usage:   "ask the model for a short rationale with every answer and store it in the log db. it is never sent to the labeler",
+				EnvVars: []string{"COMPLETIONS_RATIONALE"},
+			},
+			&cli.IntFlag{
+				Name:    "few-shot-examples",
+				Usage:   "how many reviewed replies from the log db to show the model as examples. 0 to disable",
+				EnvVars: []string{"FEW_SHOT_EXAMPLES"},
+			},
+			&cli.StringFlag{
+				Name:    "few-shot-strategy",
+				Usage:   "how to pick few shot examples. one of random, balanced or similar",
+				EnvVars: []string{"FEW_SHOT_STRATEGY"},
+				Value:   string(FewShotBalanced),
+			},
+			&cli.IntFlag{
+				Name:    "few-shot-max-tokens",
+				Usage:   "rough token budget for few shot examples. 0 for no budget",
+				EnvVars: []string{"FEW_SHOT_MAX_TOKENS"},
+				Value:   1000,
+			},
+			&cli.IntFlag{
+				Name:    "circuit-breaker-failures",
+				Usage:   "consecutive failures before a backend with fallbacks is skipped",
+				EnvVars: []string{"CIRCUIT_BREAKER_FAILURES"},
+				Value:   3,
+			},
+			&cli.DurationFlag{
+				Name:    "circuit-breaker-cooldown",
+				Usage:   "how long to skip a failing backend before probing it again",
+				EnvVars: []string{"CIRCUIT_BREAKER_COOLDOWN"},
+				Value:   30 * time.Second,
+			},
+			&cli.StringSliceFlag{
+				Name:    "label-ttls",
+				Usage:   "comma separated label=duration pairs of how long each label lasts before it expires, e.g. off-topic=72h. labels without one are permanent",
+				EnvVars: []string{"LABEL_TTLS"},
+			},
+			&cli.IntFlag{
+				Name:    "outbox-max-attempts",
+				Usage:   "how many times to try delivering a label to the labeler before moving it to the dead letter state",
+				EnvVars: []string{"OUTBOX_MAX_ATTEMPTS"},
+				Value:   8,
+			},
+			&cli.DurationFlag{
+				Name:    "outbox-base-backoff",
+				Usage:   "how long to wait before retrying a failed label delivery. doubles with every failure",
+				EnvVars: []string{"OUTBOX_BASE_BACKOFF"},
+				Value:   5 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "outbox-max-backoff",
+				Usage:   "longest wait between retries of a failed label delivery",
+				EnvVars: []string{"OUTBOX_MAX_BACKOFF"},
+				Value:   1 * time.Hour,
+			},
+			&cli.IntFlag{
+				Name:    "account-label-threshold",
+				Usage:   "label an author's account once this many of their replies were logged as bad faith within the window. 0 turns account labels off",
+				EnvVars: []string{"ACCOUNT_LABEL_THRESHOLD"},
+			},
+			&cli.DurationFlag{
+				Name:    "account-label-window",
+				Usage:   "how far back to count an author's bad faith replies",
+				EnvVars: []string{"ACCOUNT_LABEL_WINDOW"},
+				Value:   24 * time.Hour,
+			},
+			&cli.DurationFlag{
+				Name:    "account-label-ttl",
+				Usage:   "how long an account label lasts after the author's latest bad faith reply",
+				EnvVars: []string{"ACCOUNT_LABEL_TTL"},
+				Value:   7 * 24 * time.Hour,
+			},
+			&cli.DurationFlag{
+				Name:    "embeddings-sync-interval",
+				Usage:   "how often embeddings backends index newly logged replies",
+				EnvVars: []string{"EMBEDDINGS_SYNC_INTERVAL"},
+				Value:   1 * time.Minute,
+			},
+			&cli.StringFlag{
+				Name:    "language-prompts",
+				Usage:   "path to a JSON object mapping language codes to extra system prompt instructions for replies in that language",
+				EnvVars: []string{"LANGUAGE_PROMPTS"},
+			},
+			&cli.StringFlag{
+				Name:    "translate-to",
+				Usage:   "language code to translate replies in other languages to before classifying them, using the completions api. empty to never translate",
+				EnvVars: []string{"TRANSLATE_TO"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "skip-langs",
+				Usage:   "languages to ignore replies in, as did=lang. use *=lang to ignore a language for every watched op",
+				EnvVars: []string{"SKIP_LANGS"},
+			},
+			&cli.StringFlag{
+				Name:    "rules-file",
+				Usage:   "path to a json file of rules that decide some replies without asking the classifiers",
+				EnvVars: []string{"RULES_FILE"},
+			},
+			&cli.BoolFlag{
+				Name:    "injection-emit",
+				Usage:   "emit the prompt-injection label whenever the injection detector matches, instead of logging the reply for review",
+				EnvVars: []string{"INJECTION_EMIT"},
+			},
 			&cli.BoolFlag{
 				Name:    "log-no-labels",
 				Usage:   "log posts with no labels as \"no-labels\" (does not emit)",
@@ -133,54 +407,179 @@ type DontShowMeThis struct {
 
 	watchedOps    map[string]struct{}
 	watchedLogOps map[string]struct{}
+	shadowOps     map[string]struct{}
 	loggedLabels  map[string]struct{}
 
-	labelerUrl string
-	labelerKey string
+	// shadow records labels for every watched op instead of emitting them
+	shadow bool
+
+	emitter LabelEmitter
+	outbox  *Outbox
+
+	accounts *AccountLabeler
+	// labelTtls are how long emitted labels last
+	labelTtls LabelTtls
 
-	lmstudioc *LMStudioClient
+	classifier *Ensemble
+	usage      *UsageTracker
 
 	postCache *lru.LRU[string, *bsky.FeedPost]
 
-	db           *gorm.DB
-	logNoLabels  bool
+	db          *gorm.DB
+	logNoLabels bool
+
+	maxConcurrentEvents int
+
+	directory         identity.Directory
+	visionEnabled     bool
+	imageMaxBytes     int64
+	imageMaxDimension int
+
+	threadContextDepth  int
+	threadContextTokens int
+
+	replierContextEnabled bool
+	replierCache          *lru.LRU[string, *ReplierContext]
+
+	rules *RulesConfig
+	// injectionEmit emits the prompt-injection label on detector hits instead of sending them to review
+	injectionEmit bool
+
+	languages  *LanguageConfig
+	translator *Translator
 }
 
+// consumerFlags are needed to run the consumer, but not by any subcommand. they aren't marked as required, since the
+// flags of the root command are checked before a subcommand runs
+var consumerFlags = []string{"pds-url", "account-handle", "account-password", "watched-ops", "completions-api-host"}
+
 var run = func(cmd *cli.Context) error {
+	for _, name := range consumerFlags {
+		if !cmd.IsSet(name) {
+			return fmt.Errorf("required flag %q not set", name)
+		}
+	}
+
 	opt := struct {
-		PdsUrl                      string
-		JetstreamUrl                string
-		AccountHandle               string
-		AccountPassword             string
-		WatchedOps                  []string
-		WatchedLogOps               []string
-		LoggedLabels                []string
-		LabelerUrl                  string
-		LabelerKey                  string
-		LmstudioHost                string
-		LogDbName                   string
-		ModelName                   string
-		CompletionsEndpointOverride string
-		CompletionsApiKey           string
-		CompletionsApiKeyType       string
-		LogNoLabels                 bool
+		PdsUrl                       string
+		JetstreamUrl                 string
+		AccountHandle                string
+		AccountPassword              string
+		WatchedOps                   []string
+		WatchedLogOps                []string
+		LoggedLabels                 []string
+		ShadowOps                    []string
+		Shadow                       bool
+		LabelerListenAddr            string
+		LmstudioHost                 string
+		LogDbName                    string
+		ModelName                    string
+		CompletionsEndpointOverride  string
+		CompletionsApiKey            string
+		CompletionsApiKeyType        string
+		LogNoLabels                  bool
+		ClassifiersConfig            string
+		CompletionsMaxRetries        int
+		ClassificationCacheTtl       time.Duration
+		MetricsListenAddr            string
+		MaxConcurrentEvents          int
+		BatchWindow                  time.Duration
+		BatchMaxSize                 int
+		CompletionsRequestsPerMinute int
+		CompletionsTokensPerMinute   int
+		CompletionsMaxInFlight       int
+		ModelPricing                 []string
+		DailyBudget                  float64
+		MonthlyBudget                float64
+		BudgetAction                 string
+		BudgetFallbackModel          string
+		CompletionsVision            bool
+		ImageMaxBytes                int64
+		ImageMaxDimension            int
+		ThreadContextDepth           int
+		ThreadContextTokens          int
+		ReplierContext               bool
+		RulesFile                    string
+		InjectionEmit                bool
+		EmbeddingsSyncInterval       time.Duration
+		FewShotExamples              int
+		FewShotStrategy              string
+		FewShotMaxTokens             int
+		CircuitBreakerFailures       int
+		CircuitBreakerCooldown       time.Duration
+		CompletionsRationale         bool
+		LanguagePrompts              string
+		TranslateTo                  string
+		SkipLangs                    []string
+		ModelProfile                 string
+		StructuredOutput             string
+		OutboxMaxAttempts            int
+		OutboxBaseBackoff            time.Duration
+		OutboxMaxBackoff             time.Duration
+		AccountLabelThreshold        int
+		AccountLabelWindow           time.Duration
+		AccountLabelTtl              time.Duration
+		LabelTtls                    []string
 	}{
-		PdsUrl:                      cmd.String("pds-url"),
-		JetstreamUrl:                cmd.String("jetstream-url"),
-		AccountHandle:               cmd.String("account-handle"),
-		AccountPassword:             cmd.String("account-password"),
-		WatchedOps:                  cmd.StringSlice("watched-ops"),
-		WatchedLogOps:               cmd.StringSlice("watched-log-ops"),
-		LoggedLabels:                cmd.StringSlice("logged-labels"),
-		LabelerUrl:                  cmd.String("labeler-url"),
-		LabelerKey:                  cmd.String("labeler-key"),
-		LmstudioHost:                cmd.String("completions-api-host"),
-		LogDbName:                   cmd.String("log-db"),
-		ModelName:                   cmd.String("model-name"),
-		CompletionsEndpointOverride: cmd.String("completions-endpoint-override"),
-		CompletionsApiKey:           cmd.String("completions-api-key"),
-		CompletionsApiKeyType:       cmd.String("completions-api-key-type"),
-		LogNoLabels:                 cmd.Bool("log-no-labels"),
+		PdsUrl:                       cmd.String("pds-url"),
+		JetstreamUrl:                 cmd.String("jetstream-url"),
+		AccountHandle:                cmd.String("account-handle"),
+		AccountPassword:              cmd.String("account-password"),
+		WatchedOps:                   cmd.StringSlice("watched-ops"),
+		WatchedLogOps:                cmd.StringSlice("watched-log-ops"),
+		LoggedLabels:                 cmd.StringSlice("logged-labels"),
+		ShadowOps:                    cmd.StringSlice("shadow-ops"),
+		Shadow:                       cmd.Bool("shadow"),
+		LabelerListenAddr:            cmd.String("labeler-listen-addr"),
+		LmstudioHost:                 cmd.String("completions-api-host"),
+		LogDbName:                    cmd.String("log-db"),
+		ModelName:                    cmd.String("model-name"),
+		CompletionsEndpointOverride:  cmd.String("completions-endpoint-override"),
+		CompletionsApiKey:            cmd.String("completions-api-key"),
+		CompletionsApiKeyType:        cmd.String("completions-api-key-type"),
+		LogNoLabels:                  cmd.Bool("log-no-labels"),
+		ClassifiersConfig:            cmd.String("classifiers-config"),
+		CompletionsMaxRetries:        cmd.Int("completions-max-retries"),
+		ClassificationCacheTtl:       cmd.Duration("classification-cache-ttl"),
+		MetricsListenAddr:            cmd.String("metrics-listen-addr"),
+		MaxConcurrentEvents:          cmd.Int("max-concurrent-events"),
+		BatchWindow:                  cmd.Duration("batch-window"),
+		BatchMaxSize:                 cmd.Int("batch-max-size"),
+		CompletionsRequestsPerMinute: cmd.Int("completions-requests-per-minute"),
+		CompletionsTokensPerMinute:   cmd.Int("completions-tokens-per-minute"),
+		CompletionsMaxInFlight:       cmd.Int("completions-max-in-flight"),
+		ModelPricing:                 cmd.StringSlice("model-pricing"),
+		DailyBudget:                  cmd.Float64("daily-budget"),
+		MonthlyBudget:                cmd.Float64("monthly-budget"),
+		BudgetAction:                 cmd.String("budget-action"),
+		BudgetFallbackModel:          cmd.String("budget-fallback-model"),
+		CompletionsVision:            cmd.Bool("completions-vision"),
+		ImageMaxBytes:                cmd.Int64("image-max-bytes"),
+		ImageMaxDimension:            cmd.Int("image-max-dimension"),
+		ThreadContextDepth:           cmd.Int("thread-context-depth"),
+		ThreadContextTokens:          cmd.Int("thread-context-tokens"),
+		ReplierContext:               cmd.Bool("replier-context"),
+		RulesFile:                    cmd.String("rules-file"),
+		InjectionEmit:                cmd.Bool("injection-emit"),
+		EmbeddingsSyncInterval:       cmd.Duration("embeddings-sync-interval"),
+		FewShotExamples:              cmd.Int("few-shot-examples"),
+		FewShotStrategy:              cmd.String("few-shot-strategy"),
+		FewShotMaxTokens:             cmd.Int("few-shot-max-tokens"),
+		CircuitBreakerFailures:       cmd.Int("circuit-breaker-failures"),
+		CircuitBreakerCooldown:       cmd.Duration("circuit-breaker-cooldown"),
+		CompletionsRationale:         cmd.Bool("completions-rationale"),
+		LanguagePrompts:              cmd.String("language-prompts"),
+		TranslateTo:                  cmd.String("translate-to"),
+		SkipLangs:                    cmd.StringSlice("skip-langs"),
+		ModelProfile:                 cmd.String("model-profile"),
+		StructuredOutput:             cmd.String("structured-output"),
+		OutboxMaxAttempts:            cmd.Int("outbox-max-attempts"),
+		OutboxBaseBackoff:            cmd.Duration("outbox-base-backoff"),
+		OutboxMaxBackoff:             cmd.Duration("outbox-max-backoff"),
+		AccountLabelThreshold:        cmd.Int("account-label-threshold"),
+		AccountLabelWindow:           cmd.Duration("account-label-window"),
+		AccountLabelTtl:              cmd.Duration("account-label-ttl"),
+		LabelTtls:                    cmd.StringSlice("label-ttls"),
 	}
 
 	if len(opt.LoggedLabels) > 0 && opt.LogDbName == "" {
@@ -209,6 +608,12 @@ var run = func(cmd *cli.Context) error {
 		watchedLogOps[op] = struct{}{}
 	}
 
+	shadowOps := make(map[string]struct{}, len(opt.ShadowOps))
+	for _, op := range opt.ShadowOps {
+		logger.Info("adding did to shadow ops", "did", op)
+		shadowOps[op] = struct{}{}
+	}
+
 	loggedLabels := make(map[string]struct{}, len(opt.LoggedLabels))
 	for _, l := range opt.LoggedLabels {
 		logger.Info("adding label to log", "label", l)
@@ -223,7 +628,290 @@ var run = func(cmd *cli.Context) error {
 
 	httpc := util.RobustHTTPClient()
 
-	lmstudioc := NewLMStudioClient(opt.LmstudioHost, opt.CompletionsEndpointOverride, opt.CompletionsApiKey, opt.CompletionsApiKeyType, opt.ModelName, logger)
+	if opt.MetricsListenAddr != "" {
+		startMetricsServer(opt.MetricsListenAddr, logger)
+	}
+
+	var db *gorm.DB
+	if opt.LogDbName != "" {
+		var err error
+		db, err = gorm.Open(sqlite.Open(opt.LogDbName), &gorm.Config{})
+		if err != nil {
+			return fmt.Errorf("failed to create gorm db: %w", err)
+		}
+
+		logger.Info("opened gorm db for logging")
+
+		db.AutoMigrate(&LogItem{}, &ClassifierVote{}, &CachedClassification{}, &UsageRecord{}, &RuleHit{}, &ReplyEmbedding{}, &SignedLabel{}, &LabelNegation{}, &OutboxEntry{}, &ShadowLabel{}, &AccountLabel{}, &LabelExpiration{})
+	}
+
+	if (opt.Shadow || len(shadowOps) > 0) && db == nil {
+		return fmt.Errorf("shadow mode records labels in the log db, but no log db is configured")
+	}
+	if opt.Shadow {
+		logger.Info("shadow mode on, labels will be recorded instead of emitted")
+	}
+	if db == nil && !opt.InjectionEmit {
+		logger.Warn("no log db to review prompt injection detector hits in, they will be emitted")
+	}
+
+	emitter, err := openEmitter(cmd, db, httpc, logger)
+	if err != nil {
+		return err
+	}
+	if labeler, ok := emitter.(*Labeler); ok {
+		labeler.Start(opt.LabelerListenAddr)
+	}
+
+	// with a log db, labels are queued and delivered by the outbox so a labeler outage doesn't lose them
+	var outbox *Outbox
+	if db != nil {
+		outbox = NewOutbox(db, emitter, opt.OutboxMaxAttempts, opt.OutboxBaseBackoff, opt.OutboxMaxBackoff, logger)
+		go outbox.Run(context.TODO(), 1*time.Second)
+		go NewExpirySweeper(db, logger).Run(context.TODO(), 1*time.Minute)
+	}
+
+	labelTtls, err := ParseLabelTtls(opt.LabelTtls)
+	if err != nil {
+		return err
+	}
+	for l, ttl := range labelTtls {
+		logger.Info("label expires", "label", l, "ttl", ttl)
+	}
+
+	var accounts *AccountLabeler
+	if opt.AccountLabelThreshold > 0 {
+		if db == nil {
+			return fmt.Errorf("account labels are counted from the log db, but no log db is configured")
+		}
+		if _, ok := loggedLabels[LabelBadFaith]; !ok {
+			logger.Warn("account labels are enabled but bad-faith isn't in the logged labels, so no replies will be counted")
+		}
+		accounts, err = NewAccountLabeler(db, outbox, opt.AccountLabelThreshold, opt.AccountLabelWindow, opt.AccountLabelTtl, opt.Shadow, opt.ShadowOps, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create account labeler: %w", err)
+		}
+		go accounts.Run(context.TODO(), 5*time.Minute)
+	}
+
+	pricing, err := ParseModelPricing(opt.ModelPricing)
+	if err != nil {
+		return err
+	}
+
+	usage, err := NewUsageTracker(db, pricing, opt.DailyBudget, opt.MonthlyBudget, BudgetAction(opt.BudgetAction), logger)
+	if err != nil {
+		return fmt.Errorf("failed to create usage tracker: %w", err)
+	}
+
+	structuredOutput, err := ParseStructuredOutputMode(opt.StructuredOutput)
+	if err != nil {
+		return err
+	}
+
+	var profile *ModelProfile
+	if opt.ModelProfile != "" {
+		profile, err = LoadModelProfile(opt.ModelProfile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var cache *ClassificationCache
+	if db != nil && opt.ClassificationCacheTtl > 0 {
+		logger.Info("caching classifications", "ttl", opt.ClassificationCacheTtl)
+		cache = NewClassificationCache(db, opt.ClassificationCacheTtl, logger)
+		go cache.Sweep(context.TODO(), 1*time.Hour)
+	}
+
+	var examples *ExampleSelector
+	if opt.FewShotExamples > 0 {
+		if db == nil {
+			return fmt.Errorf("few shot examples need a log db")
+		}
+		examples, err = NewExampleSelector(db, FewShotStrategy(opt.FewShotStrategy), opt.FewShotExamples, opt.FewShotMaxTokens, logger)
+		if err != nil {
+			return err
+		}
+		logger.Info("showing few shot examples", "count", opt.FewShotExamples, "strategy", opt.FewShotStrategy)
+	}
+
+	if opt.BatchWindow > 0 && opt.MaxConcurrentEvents < 2 {
+		logger.Warn("batching is enabled but events are handled one at a time, so batches will only ever hold a single reply")
+	}
+
+	wrapClassifier := func(c *LMStudioClient) Classifier {
+		// probe now rather than on the first reply
+		if c.outputMode == StructuredOutputAuto {
+			go c.structuredOutputMode(context.TODO())
+		}
+		if opt.BatchWindow > 0 {
+			return NewBatchingClassifier(c, opt.BatchWindow, opt.BatchMaxSize, logger)
+		}
+		return c
+	}
+
+	var classifier *Ensemble
+	var visionEnabled bool
+	if opt.ClassifiersConfig != "" {
+		config, err := LoadClassifiersConfig(opt.ClassifiersConfig)
+		if err != nil {
+			return err
+		}
+
+		newBackend := func(b BackendConfig) (Classifier, error) {
+			if b.MaxRetries == 0 {
+				b.MaxRetries = opt.CompletionsMaxRetries
+			}
+			if b.RequestsPerMinute == 0 {
+				b.RequestsPerMinute = opt.CompletionsRequestsPerMinute
+			}
+			if b.TokensPerMinute == 0 {
+				b.TokensPerMinute = opt.CompletionsTokensPerMinute
+			}
+			if b.MaxInFlight == 0 {
+				b.MaxInFlight = opt.CompletionsMaxInFlight
+			}
+			b.Rationale = b.Rationale || opt.CompletionsRationale
+			if b.StructuredOutput == "" {
+				b.StructuredOutput = structuredOutput
+			}
+
+			if b.Kind == BackendKindEmbeddings {
+				if db == nil {
+					return nil, fmt.Errorf("embeddings backend %s needs a log db", b.Name)
+				}
+				if opt.EmbeddingsSyncInterval <= 0 {
+					return nil, fmt.Errorf("embeddings sync interval must be positive")
+				}
+				embc, err := NewEmbeddingClassifier(b, db, usage, logger)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create embeddings backend: %w", err)
+				}
+				go embc.Sync(context.TODO(), opt.EmbeddingsSyncInterval)
+				return embc, nil
+			}
+
+			visionEnabled = visionEnabled || b.Vision
+			return wrapClassifier(NewLMStudioClient(b, cache, usage, examples, logger)), nil
+		}
+
+		if BudgetAction(opt.BudgetAction) == BudgetActionFallback && !config.hasBudgetFallback() {
+			return fmt.Errorf("budget action is fallback, but no backend in the classifiers config has a budget_fallback_model")
+		}
+
+		members := make([]EnsembleMember, 0, len(config.Backends))
+		for _, b := range config.Backends {
+			logger.Info("adding classifier backend", "name", b.Name, "kind", b.Kind, "host", b.Host, "model", b.Model, "weight", b.Weight, "vision", b.Vision, "firstPass", b.FirstPass)
+
+			c, err := newBackend(b)
+			if err != nil {
+				return err
+			}
+
+			if len(b.Fallbacks) > 0 {
+				chain := []Classifier{c}
+				for _, fb := range b.Fallbacks {
+					logger.Info("adding fallback backend", "primary", b.Name, "name", fb.Name, "kind", fb.Kind, "host", fb.Host, "model", fb.Model, "vision", fb.Vision)
+					fc, err := newBackend(fb)
+					if err != nil {
+						return err
+					}
+					chain = append(chain, fc)
+				}
+				c, err = NewFallbackClassifier(chain, opt.CircuitBreakerFailures, opt.CircuitBreakerCooldown, logger)
+				if err != nil {
+					return fmt.Errorf("failed to create fallback chain: %w", err)
+				}
+			}
+
+			members = append(members, EnsembleMember{
+				Classifier: c,
+				Weight:     b.Weight,
+				FirstPass:  b.FirstPass,
+			})
+		}
+
+		classifier, err = NewEnsemble(members, config.Policy, config.WeightThreshold, config.MinVotes, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create ensemble: %w", err)
+		}
+	} else {
+		if BudgetAction(opt.BudgetAction) == BudgetActionFallback && opt.BudgetFallbackModel == "" {
+			return fmt.Errorf("budget action is fallback, but no fallback model was given")
+		}
+
+		lmstudioc := NewLMStudioClient(BackendConfig{
+			Host:             opt.LmstudioHost,
+			EndpointOverride: opt.CompletionsEndpointOverride,
+			ApiKey:           opt.CompletionsApiKey,
+			ApiKeyType:       opt.CompletionsApiKeyType,
+			Model:            opt.ModelName,
+			MaxRetries:       opt.CompletionsMaxRetries,
+
+			RequestsPerMinute: opt.CompletionsRequestsPerMinute,
+			TokensPerMinute:   opt.CompletionsTokensPerMinute,
+			MaxInFlight:       opt.CompletionsMaxInFlight,
+
+			Vision:              opt.CompletionsVision,
+			Rationale:           opt.CompletionsRationale,
+			Profile:             profile,
+			StructuredOutput:    structuredOutput,
+			BudgetFallbackModel: opt.BudgetFallbackModel,
+		}, cache, usage, examples, logger)
+		visionEnabled = opt.CompletionsVision
+
+		var err error
+		classifier, err = NewEnsemble([]EnsembleMember{{Classifier: wrapClassifier(lmstudioc)}}, PolicyUnanimous, 0, 0, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create ensemble: %w", err)
+		}
+	}
+
+	var rules *RulesConfig
+	if opt.RulesFile != "" {
+		rules, err = LoadRules(opt.RulesFile)
+		if err != nil {
+			return err
+		}
+		logger.Info("loaded rules", "count", len(rules.Rules))
+	}
+
+	languages := &LanguageConfig{
+		TranslateTo: baseLanguage(opt.TranslateTo),
+	}
+	if opt.LanguagePrompts != "" {
+		languages.Prompts, err = LoadLanguagePrompts(opt.LanguagePrompts)
+		if err != nil {
+			return err
+		}
+		logger.Info("loaded language prompts", "count", len(languages.Prompts))
+	}
+	languages.Skip, err = ParseSkipLangs(opt.SkipLangs)
+	if err != nil {
+		return err
+	}
+
+	var translator *Translator
+	if languages.TranslateTo != "" {
+		// translations always go to the main completions api, even when classifying with a classifiers config
+		translator = NewTranslator(NewLMStudioClient(BackendConfig{
+			Name:             "translator",
+			Host:             opt.LmstudioHost,
+			EndpointOverride: opt.CompletionsEndpointOverride,
+			ApiKey:           opt.CompletionsApiKey,
+			ApiKeyType:       opt.CompletionsApiKeyType,
+			Model:            opt.ModelName,
+			MaxRetries:       opt.CompletionsMaxRetries,
+
+			RequestsPerMinute: opt.CompletionsRequestsPerMinute,
+			TokensPerMinute:   opt.CompletionsTokensPerMinute,
+			MaxInFlight:       opt.CompletionsMaxInFlight,
+
+			Profile: profile,
+		}, nil, usage, nil, logger), languages.TranslateTo, logger)
+		logger.Info("translating replies before classification", "to", languages.TranslateTo)
+	}
 
 	postCache := lru.NewLRU[string, *bsky.FeedPost](100, nil, 1*time.Hour)
 
@@ -232,29 +920,41 @@ var run = func(cmd *cli.Context) error {
 			Level:     slog.LevelInfo,
 			AddSource: true,
 		})),
-		labelerUrl:    opt.LabelerUrl,
-		labelerKey:    opt.LabelerKey,
+		emitter:       emitter,
+		outbox:        outbox,
+		accounts:      accounts,
+		labelTtls:     labelTtls,
 		watchedOps:    watchedOps,
 		watchedLogOps: watchedLogOps,
+		shadowOps:     shadowOps,
+		shadow:        opt.Shadow,
 		loggedLabels:  loggedLabels,
 		xrpcc:         xrpcc,
 		httpc:         httpc,
-		lmstudioc:     lmstudioc,
+		classifier:    classifier,
+		usage:         usage,
 		postCache:     postCache,
 		logNoLabels:   opt.LogNoLabels,
-	}
+		db:            db,
 
-	if opt.LogDbName != "" {
-		db, err := gorm.Open(sqlite.Open(opt.LogDbName), &gorm.Config{})
-		if err != nil {
-			return fmt.Errorf("failed to create gorm db: %w", err)
-		}
+		maxConcurrentEvents: opt.MaxConcurrentEvents,
 
-		logger.Info("opened gorm db for logging")
+		directory:         identity.DefaultDirectory(),
+		visionEnabled:     visionEnabled,
+		imageMaxBytes:     opt.ImageMaxBytes,
+		imageMaxDimension: opt.ImageMaxDimension,
+
+		threadContextDepth:  opt.ThreadContextDepth,
+		threadContextTokens: opt.ThreadContextTokens,
+
+		replierContextEnabled: opt.ReplierContext,
+		replierCache:          lru.NewLRU[string, *ReplierContext](1000, nil, 30*time.Minute),
 
-		db.AutoMigrate(&LogItem{})
+		rules:         rules,
+		injectionEmit: opt.InjectionEmit,
 
-		dsmt.db = db
+		languages:  languages,
+		translator: translator,
 	}
 
 	dsmt.startConsumer(cmd.String("jetstream-url"))
@@ -262,12 +962,32 @@ var run = func(cmd *cli.Context) error {
 	return nil
 }
 
+// openLogDb opens the log db for subcommands, which share the root command's flags
+func openLogDb(cmd *cli.Context) (*gorm.DB, error) {
+	name := cmd.String("log-db")
+	if name == "" {
+		return nil, fmt.Errorf("no log db configured")
+	}
+
+	db, err := gorm.Open(sqlite.Open(name), &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open gorm db: %w", err)
+	}
+
+	return db, nil
+}
+
 func (dsmt *DontShowMeThis) startConsumer(jetstreamUrl string) {
 	config := client.DefaultClientConfig()
 	config.WebsocketURL = jetstreamUrl
 	config.Compress = true
 
-	scheduler := sequential.NewScheduler("jetstream_localdev", dsmt.logger, dsmt.handleEvent)
+	var scheduler client.Scheduler
+	if dsmt.maxConcurrentEvents > 1 {
+		scheduler = parallel.NewScheduler(dsmt.maxConcurrentEvents, "jetstream_localdev", dsmt.logger, dsmt.handleEvent)
+	} else {
+		scheduler = sequential.NewScheduler("jetstream_localdev", dsmt.logger, dsmt.handleEvent)
+	}
 
 	c, err := client.NewClient(config, dsmt.logger, scheduler)
 	if err != nil {
@@ -298,43 +1018,8 @@ func (dsmt *DontShowMeThis) handleEvent(ctx context.Context, event *models.Event
 	return nil
 }
 
-type EmitLabelRequest struct {
-	Uri   string `json:"uri"`
-	Label string `json:"label"`
-}
-
-func (dsmt *DontShowMeThis) emitLabel(ctx context.Context, uri, label string) error {
-	body := &EmitLabelRequest{
-		Uri:   uri,
-		Label: label,
-	}
-
-	b, err := json.Marshal(body)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequestWithContext(ctx, "POST", dsmt.labelerUrl+"/emit", bytes.NewReader(b))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("authorization", "Bearer "+dsmt.labelerKey)
-	req.Header.Set("content-type", "application/json")
-
-	resp, err := dsmt.httpc.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	io.Copy(io.Discard, resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("received invalid status code from server: %d", resp.StatusCode)
-	}
-
-	return nil
+func (dsmt *DontShowMeThis) emitLabel(ctx context.Context, uri, label string, exp *time.Time) error {
+	return dsmt.emitter.Emit(ctx, uri, label, exp)
 }
 
 func (dsmt *DontShowMeThis) getPost(ctx context.Context, uri string) (*bsky.FeedPost, error) {
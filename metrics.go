@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	cacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dontshowmethis_classification_cache_hits_total",
+		Help: "Number of classifications served from the persistent cache",
+	}, []string{"backend"})
+
+	cacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dontshowmethis_classification_cache_misses_total",
+		Help: "Number of classifications that had to be sent to the completions api",
+	}, []string{"backend"})
+
+	rateLimitWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dontshowmethis_completions_queue_wait_seconds",
+		Help:    "How long completions requests waited for the client side rate limiter",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"backend"})
+
+	rateLimitInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dontshowmethis_completions_in_flight",
+		Help: "Number of completions requests currently in flight",
+	}, []string{"backend"})
+
+	completionsTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dontshowmethis_completions_tokens_total",
+		Help: "Tokens used by the completions api, as reported by the api",
+	}, []string{"backend", "kind"})
+
+	completionsCost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dontshowmethis_completions_cost_usd_total",
+		Help: "Spend on the completions api in USD, based on the configured model pricing",
+	}, []string{"backend"})
+
+	ruleHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dontshowmethis_rule_hits_total",
+		Help: "Number of replies decided by a rule before reaching the classifiers",
+	}, []string{"rule", "action"})
+
+	circuitStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dontshowmethis_circuit_state",
+		Help: "State of each backend's circuit breaker. 0 is closed, 1 is open and 2 is half open",
+	}, []string{"backend"})
+
+	labelerSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dontshowmethis_labeler_subscribers",
+		Help: "Number of connected subscribeLabels consumers of the built in labeler",
+	})
+
+	outboxDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dontshowmethis_outbox_deliveries_total",
+		Help: "Attempts to deliver queued labels to the labeler, by result. result is delivered, failed, dead or expired",
+	}, []string{"result"})
+
+	shadowLabels = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dontshowmethis_shadow_labels_total",
+		Help: "Labels recorded instead of emitted because the op is in shadow mode",
+	}, []string{"label"})
+
+	accountLabelChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dontshowmethis_account_labels_total",
+		Help: "Account labels emitted on or negated from reply authors, by action",
+	}, []string{"action"})
+
+	labelExpirations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dontshowmethis_label_expirations_total",
+		Help: "Delivered labels that lapsed at their exp",
+	}, []string{"label"})
+
+	spendGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dontshowmethis_completions_spend_usd",
+		Help: "Spend on the completions api in USD for the current UTC day or month",
+	}, []string{"period"})
+)
+
+func startMetricsServer(addr string, logger *slog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		logger.Info("starting metrics server", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("metrics server stopped", "error", err)
+		}
+	}()
+}
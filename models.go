@@ -4,11 +4,53 @@ import "gorm.io/gorm"
 
 type LogItem struct {
 	gorm.Model
-	ParentDid  string `gorm:"index"`
-	AuthorDid  string `gorm:"index"`
-	ParentUri  string `gorm:"index"`
-	AuthorUri  string
-	ParentText string
-	AuthorText string
-	Label      string `gorm:"index"`
+	ParentDid   string `gorm:"index"`
+	AuthorDid   string `gorm:"index"`
+	ParentUri   string `gorm:"index"`
+	AuthorUri   string
+	ParentText  string
+	AuthorText  string
+	Label       string `gorm:"index"`
+	NeedsReview bool   `gorm:"index"`
+	// Lang is the declared or detected language of the reply, empty when it couldn't be told
+	Lang string `gorm:"index"`
+
+	// Backend is the comma separated list of backends that decided the label, or the rule that did
+	Backend string
+	// Rationale and Reasoning are the models' explanations, when asked for. they are never sent to the labeler
+	Rationale string
+	Reasoning string
+
+	// Reviewed is set once a person has looked at the label, and Confirmed if they agreed with it
+	Reviewed  bool `gorm:"index"`
+	Confirmed bool
+}
+
+// ClassifierVote is a single backend's answer for a reply, kept so that ensemble disagreements can be analyzed later
+type ClassifierVote struct {
+	gorm.Model
+	AuthorUri       string `gorm:"index"`
+	ParentUri       string
+	Backend         string `gorm:"index"`
+	Weight          float64
+	BadFaith        bool
+	OffTopic        bool
+	Funny           bool
+	PromptInjection bool
+	Rationale       string
+	Reasoning       string
+	Error           string
+}
+
+// UsageRecord is the token usage and cost of a single completions request
+type UsageRecord struct {
+	gorm.Model
+	Backend          string `gorm:"index"`
+	ModelName        string `gorm:"column:model"`
+	OpDid            string `gorm:"index"`
+	AuthorUri        string `gorm:"index"`
+	Labels           string
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
 }
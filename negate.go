@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+// LabelNegation is a record of a label being taken off a post, and who did it and why
+type LabelNegation struct {
+	gorm.Model
+	Uri    string `gorm:"index"`
+	Label  string `gorm:"index"`
+	Actor  string
+	Reason string
+}
+
+var negateCommand = &cli.Command{
+	Name:  "negate",
+	Usage: "take a label off a post, or off every logged post matching a query",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "label",
+			Usage:    "the label to take off",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "uri",
+			Usage: "the post to take the label off",
+		},
+		&cli.StringFlag{
+			Name:  "author-did",
+			Usage: "take the label off logged replies written by this account",
+		},
+		&cli.StringFlag{
+			Name:  "parent-did",
+			Usage: "take the label off logged replies to this account",
+		},
+		&cli.DurationFlag{
+			Name:  "since",
+			Usage: "only take the label off replies logged this recently",
+		},
+		&cli.StringFlag{
+			Name:     "reason",
+			Usage:    "why the label is wrong. stored with every negation",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "actor",
+			Usage:   "who is negating the label. stored with every negation",
+			EnvVars: []string{"USER"},
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "list the posts the label would be taken off without negating anything",
+		},
+	},
+	Action: func(cmd *cli.Context) error {
+		label := cmd.String("label")
+		if !slices.Contains(AllLabels, label) && !slices.Contains(AccountLabels, label) {
+			return fmt.Errorf("unknown label %q", label)
+		}
+		actor := cmd.String("actor")
+		if actor == "" {
+			return fmt.Errorf("no actor given")
+		}
+
+		db, err := openLogDb(cmd)
+		if err != nil {
+			return err
+		}
+		db.AutoMigrate(&LabelNegation{}, &OutboxEntry{})
+
+		var uris []string
+		if uri := cmd.String("uri"); uri != "" {
+			if cmd.IsSet("author-did") || cmd.IsSet("parent-did") || cmd.IsSet("since") {
+				return fmt.Errorf("give either a uri or a query, not both")
+			}
+			uris = []string{uri}
+		} else {
+			if !cmd.IsSet("author-did") && !cmd.IsSet("parent-did") && !cmd.IsSet("since") {
+				return fmt.Errorf("give a uri, or at least one of --author-did, --parent-did and --since")
+			}
+
+			q := db.Model(&LogItem{}).Where("label = ?", label)
+			if did := cmd.String("author-did"); did != "" {
+				q = q.Where("author_did = ?", did)
+			}
+			if did := cmd.String("parent-did"); did != "" {
+				q = q.Where("parent_did = ?", did)
+			}
+			if since := cmd.Duration("since"); since > 0 {
+				q = q.Where("created_at > ?", time.Now().Add(-since))
+			}
+			if err := q.Distinct().Pluck("author_uri", &uris).Error; err != nil {
+				return fmt.Errorf("failed to find logged replies: %w", err)
+			}
+		}
+
+		if cmd.Bool("dry-run") {
+			for _, uri := range uris {
+				fmt.Println(uri)
+			}
+			fmt.Printf("would take %s off %d posts\n", label, len(uris))
+			return nil
+		}
+
+		failed := 0
+		for _, uri := range uris {
+			if err := NegateLabel(db, uri, label, actor, cmd.String("reason")); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to take %s off %s: %v\n", label, uri, err)
+				failed++
+			}
+		}
+
+		fmt.Printf("queued taking %s off %d of %d posts, the running consumer will send them to the labeler\n", label, len(uris)-failed, len(uris))
+		if failed > 0 {
+			return fmt.Errorf("%d negations failed", failed)
+		}
+		return nil
+	},
+}
+
+// NegateLabel queues taking a label off a post in the outbox, and records who did it and why. Emits of the label still
+// waiting in the outbox are cancelled by it. The label's log rows are marked as reviewed and rejected, so the reply can
+// be shown to the model as an example of what the label isn't.
+func NegateLabel(db *gorm.DB, uri, label, actor, reason string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := enqueueLabel(tx, uri, label, true, nil); err != nil {
+			return err
+		}
+
+		negation := LabelNegation{
+			Uri:    uri,
+			Label:  label,
+			Actor:  actor,
+			Reason: reason,
+		}
+		if err := tx.Create(&negation).Error; err != nil {
+			return fmt.Errorf("failed to record negation: %w", err)
+		}
+
+		if err := tx.Model(&LogItem{}).Where("author_uri = ? AND label = ?", uri, label).Updates(map[string]any{
+			"reviewed":  true,
+			"confirmed": false,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to mark log items as rejected: %w", err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+type OutboxState string
+
+const (
+	// waiting to be delivered, or to be retried after a failure
+	OutboxPending OutboxState = "pending"
+	// accepted by the labeler
+	OutboxDelivered OutboxState = "delivered"
+	// failed too many times and won't be retried unless asked to
+	OutboxDead OutboxState = "dead"
+	// the label's exp passed before it could be delivered, so it was dropped
+	OutboxExpired OutboxState = "expired"
+	// a later entry for the same post and label was queued before this one was delivered
+	OutboxCancelled OutboxState = "cancelled"
+)
+
+// how many entries the worker delivers per pass
+const outboxBatchSize = 100
+
+// OutboxEntry is a label waiting to be sent to the labeler. Entries are written in the same transaction as the log
+// rows for the reply, so a label is never lost between deciding on it and delivering it.
+type OutboxEntry struct {
+	gorm.Model
+	Uri   string `gorm:"index"`
+	Label string
+	// Neg takes the label off instead of adding it
+	Neg bool
+	// Exp is when the label expires, nil for labels that don't
+	Exp *time.Time
+
+	State         OutboxState `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     string
+	DeliveredAt   *time.Time
+}
+
+// enqueueLabel adds a label to the outbox. Pass the transaction the reply's log rows are written in. Undelivered
+// entries for the same post and label are cancelled, since whatever they would have done is superseded by this one.
+func enqueueLabel(tx *gorm.DB, uri, label string, neg bool, exp *time.Time) error {
+	if err := tx.Model(&OutboxEntry{}).
+		Where("uri = ? AND label = ? AND state IN ?", uri, label, []OutboxState{OutboxPending, OutboxDead}).
+		Update("state", OutboxCancelled).Error; err != nil {
+		return fmt.Errorf("failed to cancel superseded outbox entries: %w", err)
+	}
+
+	entry := OutboxEntry{
+		Uri:           uri,
+		Label:         label,
+		Neg:           neg,
+		Exp:           exp,
+		State:         OutboxPending,
+		NextAttemptAt: time.Now(),
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return fmt.Errorf("failed to queue label: %w", err)
+	}
+	return nil
+}
+
+// Outbox delivers queued labels to the emitter, retrying failures with exponential backoff until they have failed
+// maxAttempts times, at which point they are dead lettered
+type Outbox struct {
+	db          *gorm.DB
+	emitter     LabelEmitter
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	logger      *slog.Logger
+
+	wake chan struct{}
+}
+
+func NewOutbox(db *gorm.DB, emitter LabelEmitter, maxAttempts int, baseBackoff, maxBackoff time.Duration, logger *slog.Logger) *Outbox {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Outbox{
+		db:          db,
+		emitter:     emitter,
+		maxAttempts: max(maxAttempts, 1),
+		baseBackoff: baseBackoff,
+		maxBackoff:  maxBackoff,
+		logger:      logger.With("component", "outbox"),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the worker so newly queued labels go out right away instead of on the next poll
+func (o *Outbox) Notify() {
+	if o == nil {
+		return
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers due entries until the context is done. It also polls, which picks up retries and entries reset by
+// the outbox retry command.
+func (o *Outbox) Run(ctx context.Context, pollInterval time.Duration) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for o.deliverDue(ctx) == outboxBatchSize {
+			// a full batch means there may be more waiting
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// deliverDue sends one batch of due entries and returns how many it tried. An entry waits for every earlier pending
+// entry for the same post and label, so they reach the labeler in the order they were queued.
+func (o *Outbox) deliverDue(ctx context.Context) int {
+	var entries []OutboxEntry
+	if err := o.db.WithContext(ctx).
+		Where("state = ? AND next_attempt_at <= ?", OutboxPending, time.Now()).
+		Where("NOT EXISTS (SELECT 1 FROM outbox_entries o WHERE o.uri = outbox_entries.uri AND o.label = outbox_entries.label AND o.state = ? AND o.id < outbox_entries.id AND o.deleted_at IS NULL)", OutboxPending).
+		Order("id").
+		Limit(outboxBatchSize).
+		Find(&entries).Error; err != nil {
+		o.logger.Error("failed to load outbox entries", "error", err)
+		return 0
+	}
+
+	for i := range entries {
+		o.deliver(ctx, &entries[i])
+	}
+
+	return len(entries)
+}
+
+func (o *Outbox) deliver(ctx context.Context, entry *OutboxEntry) {
+	logger := o.logger.With("id", entry.ID, "uri", entry.Uri, "label", entry.Label, "neg", entry.Neg)
+
+	// a label retried past its exp would be expired on arrival
+	if !entry.Neg && entry.Exp != nil && entry.Exp.Before(time.Now()) {
+		entry.State = OutboxExpired
+		outboxDeliveries.WithLabelValues("expired").Inc()
+		logger.Warn("label expired before it could be delivered", "attempts", entry.Attempts, "exp", entry.Exp)
+		o.save(logger, entry)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var err error
+	if entry.Neg {
+		err = o.emitter.Negate(ctx, entry.Uri, entry.Label)
+	} else {
+		err = o.emitter.Emit(ctx, entry.Uri, entry.Label, entry.Exp)
+	}
+
+	entry.Attempts++
+	if err == nil {
+		now := time.Now()
+		entry.State = OutboxDelivered
+		entry.DeliveredAt = &now
+		entry.LastError = ""
+		outboxDeliveries.WithLabelValues("delivered").Inc()
+		logger.Info("emitted label", "attempts", entry.Attempts)
+	} else {
+		entry.LastError = err.Error()
+		if entry.Attempts >= o.maxAttempts {
+			entry.State = OutboxDead
+			outboxDeliveries.WithLabelValues("dead").Inc()
+			logger.Error("giving up on label, moved to dead letter", "attempts", entry.Attempts, "error", err)
+		} else {
+			backoff := o.backoff(entry.Attempts)
+			entry.NextAttemptAt = time.Now().Add(backoff)
+			outboxDeliveries.WithLabelValues("failed").Inc()
+			logger.Warn("failed to emit label, will retry", "attempts", entry.Attempts, "retryIn", backoff, "error", err)
+		}
+	}
+
+	o.save(logger, entry)
+}
+
+// save stores the outcome of a delivery. An entry cancelled while it was being delivered stays cancelled unless it got
+// through, so a failed emit can't be retried after the entry that superseded it.
+func (o *Outbox) save(logger *slog.Logger, entry *OutboxEntry) {
+	q := o.db.Model(&OutboxEntry{}).Where("id = ?", entry.ID)
+	if entry.State != OutboxDelivered {
+		q = q.Where("state = ?", OutboxPending)
+	}
+	if err := q.Updates(map[string]any{
+		"state":           entry.State,
+		"attempts":        entry.Attempts,
+		"next_attempt_at": entry.NextAttemptAt,
+		"last_error":      entry.LastError,
+		"delivered_at":    entry.DeliveredAt,
+	}).Error; err != nil {
+		logger.Error("failed to update outbox entry", "error", err)
+	}
+}
+
+// backoff doubles with every failed attempt, up to the max
+func (o *Outbox) backoff(attempts int) time.Duration {
+	backoff := o.baseBackoff
+	for i := 1; i < attempts && backoff < o.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, o.maxBackoff)
+}
+
+var outboxCommand = &cli.Command{
+	Name:  "outbox",
+	Usage: "inspect and retry labels waiting to be sent to the labeler",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "list",
+			Usage: "list outbox entries that haven't been delivered",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "state",
+					Usage: "only list entries in this state, one of \"pending\", \"dead\", \"expired\", \"cancelled\" or \"delivered\"",
+				},
+				&cli.IntFlag{
+					Name:  "limit",
+					Usage: "most rows to list",
+					Value: 20,
+				},
+			},
+			Action: func(cmd *cli.Context) error {
+				db, err := openLogDb(cmd)
+				if err != nil {
+					return err
+				}
+
+				q := db.Where("state IN ?", []OutboxState{OutboxPending, OutboxDead})
+				if state := cmd.String("state"); state != "" {
+					q = db.Where("state = ?", state)
+				}
+
+				var entries []OutboxEntry
+				if err := q.Order("id DESC").Limit(cmd.Int("limit")).Find(&entries).Error; err != nil {
+					return fmt.Errorf("failed to load outbox entries: %w", err)
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "ID\tSTATE\tLABEL\tNEG\tATTEMPTS\tNEXT ATTEMPT\tURI\tLAST ERROR")
+				for _, e := range entries {
+					fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%d\t%s\t%s\t%s\n", e.ID, e.State, e.Label, e.Neg, e.Attempts, e.NextAttemptAt.Format(time.RFC3339), e.Uri, oneLine(e.LastError, 60))
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:      "retry",
+			Usage:     "send outbox entries again on the consumer's next poll, resetting their attempts",
+			ArgsUsage: "<id>...",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "all-dead",
+					Usage: "retry every dead entry",
+				},
+			},
+			Action: func(cmd *cli.Context) error {
+				ids := make([]uint, 0, cmd.NArg())
+				for _, arg := range cmd.Args().Slice() {
+					id, err := strconv.ParseUint(arg, 10, 64)
+					if err != nil {
+						return fmt.Errorf("bad outbox entry id %q: %w", arg, err)
+					}
+					ids = append(ids, uint(id))
+				}
+				if len(ids) == 0 && !cmd.Bool("all-dead") {
+					return fmt.Errorf("no outbox entry ids given")
+				}
+
+				db, err := openLogDb(cmd)
+				if err != nil {
+					return err
+				}
+
+				q := db.Model(&OutboxEntry{}).Where("state IN ?", []OutboxState{OutboxPending, OutboxDead})
+				if cmd.Bool("all-dead") {
+					q = q.Where("state = ?", OutboxDead)
+				}
+				if len(ids) > 0 {
+					q = q.Where("id IN ?", ids)
+				}
+
+				res := q.Updates(map[string]any{
+					"state":           OutboxPending,
+					"attempts":        0,
+					"next_attempt_at": time.Now(),
+				})
+				if res.Error != nil {
+					return fmt.Errorf("failed to update outbox entries: %w", res.Error)
+				}
+
+				fmt.Printf("queued %d outbox entries for retry\n", res.RowsAffected)
+				return nil
+			},
+		},
+	},
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type fakeEmitter struct {
+	calls []string
+	err   error
+	// during is called in the middle of every delivery, before it returns
+	during func()
+}
+
+func (f *fakeEmitter) Emit(ctx context.Context, uri, label string, exp *time.Time) error {
+	return f.record(fmt.Sprintf("emit %s %s", uri, label))
+}
+
+func (f *fakeEmitter) Negate(ctx context.Context, uri, label string) error {
+	return f.record(fmt.Sprintf("negate %s %s", uri, label))
+}
+
+func (f *fakeEmitter) record(call string) error {
+	f.calls = append(f.calls, call)
+	if f.during != nil {
+		f.during()
+	}
+	return f.err
+}
+
+func openTestDb(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "log.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	if err := db.AutoMigrate(&OutboxEntry{}); err != nil {
+		t.Fatalf("failed to migrate db: %v", err)
+	}
+	return db
+}
+
+func newTestOutbox(db *gorm.DB, emitter LabelEmitter) *Outbox {
+	return NewOutbox(db, emitter, 3, time.Minute, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func outboxStates(t *testing.T, db *gorm.DB) []OutboxState {
+	t.Helper()
+
+	var entries []OutboxEntry
+	if err := db.Order("id").Find(&entries).Error; err != nil {
+		t.Fatal(err)
+	}
+	states := make([]OutboxState, len(entries))
+	for i, e := range entries {
+		states[i] = e.State
+	}
+	return states
+}
+
+func TestOutboxDeliversInQueueOrder(t *testing.T) {
+	db := openTestDb(t)
+	emitter := &fakeEmitter{}
+	outbox := newTestOutbox(db, emitter)
+
+	// the first entry is waiting out a backoff, so the later one for the same post and label has to wait for it
+	now := time.Now()
+	entries := []OutboxEntry{
+		{Uri: "at://a", Label: LabelBadFaith, State: OutboxPending, NextAttemptAt: now.Add(time.Hour), Attempts: 1},
+		{Uri: "at://a", Label: LabelBadFaith, Neg: true, State: OutboxPending, NextAttemptAt: now},
+		{Uri: "at://b", Label: LabelBadFaith, State: OutboxPending, NextAttemptAt: now},
+		{Uri: "at://a", Label: LabelOffTopic, State: OutboxPending, NextAttemptAt: now},
+	}
+	if err := db.Create(&entries).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if n := outbox.deliverDue(ctx); n != 2 {
+		t.Fatalf("first pass delivered %d entries, want 2", n)
+	}
+	want := []string{"emit at://b bad-faith", "emit at://a off-topic"}
+	if !slices.Equal(emitter.calls, want) {
+		t.Fatalf("calls = %v, want %v", emitter.calls, want)
+	}
+
+	if err := db.Model(&OutboxEntry{}).Where("id = ?", entries[0].ID).Update("next_attempt_at", now).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	outbox.deliverDue(ctx)
+	outbox.deliverDue(ctx)
+	want = append(want, "emit at://a bad-faith", "negate at://a bad-faith")
+	if !slices.Equal(emitter.calls, want) {
+		t.Fatalf("calls = %v, want %v", emitter.calls, want)
+	}
+}
+
+func TestEnqueueLabelCancelsUndelivered(t *testing.T) {
+	db := openTestDb(t)
+	emitter := &fakeEmitter{}
+	outbox := newTestOutbox(db, emitter)
+
+	if err := enqueueLabel(db, "at://a", LabelBadFaith, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := enqueueLabel(db, "at://a", LabelBadFaith, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	outbox.deliverDue(context.Background())
+
+	if want := []string{"negate at://a bad-faith"}; !slices.Equal(emitter.calls, want) {
+		t.Errorf("calls = %v, want %v", emitter.calls, want)
+	}
+	if want := []OutboxState{OutboxCancelled, OutboxDelivered}; !slices.Equal(outboxStates(t, db), want) {
+		t.Errorf("states = %v, want %v", outboxStates(t, db), want)
+	}
+}
+
+func TestOutboxFailedDeliveryStaysCancelled(t *testing.T) {
+	db := openTestDb(t)
+	emitter := &fakeEmitter{err: errors.New("labeler is down")}
+	outbox := newTestOutbox(db, emitter)
+
+	if err := enqueueLabel(db, "at://a", LabelBadFaith, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a negation queued while the emit is in flight supersedes it, so the failed emit must not be retried
+	emitter.during = func() {
+		emitter.during = nil
+		if err := enqueueLabel(db, "at://a", LabelBadFaith, true, nil); err != nil {
+			t.Error(err)
+		}
+	}
+
+	outbox.deliverDue(context.Background())
+
+	if want := []OutboxState{OutboxCancelled, OutboxPending}; !slices.Equal(outboxStates(t, db), want) {
+		t.Errorf("states = %v, want %v", outboxStates(t, db), want)
+	}
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	db := openTestDb(t)
+	emitter := &fakeEmitter{err: errors.New("labeler is down")}
+	outbox := newTestOutbox(db, emitter)
+
+	if err := enqueueLabel(db, "at://a", LabelBadFaith, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for range outbox.maxAttempts {
+		if err := db.Model(&OutboxEntry{}).Where("state = ?", OutboxPending).Update("next_attempt_at", time.Now()).Error; err != nil {
+			t.Fatal(err)
+		}
+		outbox.deliverDue(ctx)
+	}
+
+	if want := []OutboxState{OutboxDead}; !slices.Equal(outboxStates(t, db), want) {
+		t.Errorf("states = %v, want %v", outboxStates(t, db), want)
+	}
+	if len(emitter.calls) != outbox.maxAttempts {
+		t.Errorf("delivered %d times, want %d", len(emitter.calls), outbox.maxAttempts)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ReasoningFormat is how a model hands back its thinking
+type ReasoningFormat string
+
+const (
+	// look for thinking both in reasoning_content and in <think> blocks
+	ReasoningAuto ReasoningFormat = ""
+	// thinking comes first in the content, inside <think> blocks
+	ReasoningThinkTags ReasoningFormat = "think-tags"
+	// thinking comes back in the separate reasoning_content field
+	ReasoningField ReasoningFormat = "field"
+	// the model thinks, but the api never returns it
+	ReasoningHidden ReasoningFormat = "hidden"
+	// the model doesn't think
+	ReasoningNone ReasoningFormat = "none"
+)
+
+// ModelProfile describes what a model needs from a request and how to read its response. The zero value is a plain
+// chat model that supports everything.
+type ModelProfile struct {
+	// AnswerTokens is the budget for each reply's answer, 0 for the default
+	AnswerTokens int `json:"answer_tokens"`
+	// ReasoningTokens are added to every request's budget so thinking doesn't cut the answer off
+	ReasoningTokens int             `json:"reasoning_tokens"`
+	Reasoning       ReasoningFormat `json:"reasoning"`
+
+	NoResponseFormat bool `json:"no_response_format"`
+	NoTemperature    bool `json:"no_temperature"`
+	NoSystemMessages bool `json:"no_system_messages"`
+	// MaxCompletionTokens sends the budget as max_completion_tokens, which some reasoning apis require instead of max_tokens
+	MaxCompletionTokens bool `json:"max_completion_tokens"`
+}
+
+// builtinProfiles are matched against the model name without any "org/" prefix. the first matching prefix wins.
+var builtinProfiles = []struct {
+	prefix  string
+	profile ModelProfile
+}{
+	{"o1-mini", ModelProfile{ReasoningTokens: 4096, Reasoning: ReasoningHidden, NoTemperature: true, NoSystemMessages: true, NoResponseFormat: true, MaxCompletionTokens: true}},
+	{"o1", ModelProfile{ReasoningTokens: 4096, Reasoning: ReasoningHidden, NoTemperature: true, MaxCompletionTokens: true}},
+	{"o3", ModelProfile{ReasoningTokens: 4096, Reasoning: ReasoningHidden, NoTemperature: true, MaxCompletionTokens: true}},
+	{"o4", ModelProfile{ReasoningTokens: 4096, Reasoning: ReasoningHidden, NoTemperature: true, MaxCompletionTokens: true}},
+	{"gpt-5", ModelProfile{ReasoningTokens: 4096, Reasoning: ReasoningHidden, NoTemperature: true, MaxCompletionTokens: true}},
+	{"gpt-oss", ModelProfile{ReasoningTokens: 2048, Reasoning: ReasoningField}},
+	{"deepseek-r1", ModelProfile{ReasoningTokens: 2048, Reasoning: ReasoningThinkTags}},
+	{"qwq", ModelProfile{ReasoningTokens: 2048, Reasoning: ReasoningThinkTags}},
+	{"qwen3", ModelProfile{ReasoningTokens: 2048, Reasoning: ReasoningThinkTags}},
+	{"magistral", ModelProfile{ReasoningTokens: 2048, Reasoning: ReasoningThinkTags}},
+	{"phi-4-reasoning", ModelProfile{ReasoningTokens: 2048, Reasoning: ReasoningThinkTags}},
+}
+
+// ProfileForModel returns the built in profile for a model, or the zero profile if there is none
+func ProfileForModel(model string) ModelProfile {
+	name := strings.ToLower(model)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	for _, p := range builtinProfiles {
+		if strings.HasPrefix(name, p.prefix) {
+			return p.profile
+		}
+	}
+	return ModelProfile{}
+}
+
+// LoadModelProfile reads a profile from a JSON file
+func LoadModelProfile(path string) (*ModelProfile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model profile: %w", err)
+	}
+
+	var profile ModelProfile
+	if err := json.Unmarshal(b, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse model profile: %w", err)
+	}
+	if err := profile.validate(); err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+func (p *ModelProfile) validate() error {
+	switch p.Reasoning {
+	case ReasoningAuto, ReasoningThinkTags, ReasoningField, ReasoningHidden, ReasoningNone:
+	default:
+		return fmt.Errorf("unknown reasoning format %q", p.Reasoning)
+	}
+	if p.AnswerTokens < 0 || p.ReasoningTokens < 0 {
+		return fmt.Errorf("token budgets can't be negative")
+	}
+	return nil
+}
+
+// reasoning returns the thinking in a message, looking where the profile says the model puts it
+func (p *ModelProfile) reasoning(m Message) string {
+	switch p.Reasoning {
+	case ReasoningField:
+		return strings.TrimSpace(m.ReasoningContent)
+	case ReasoningThinkTags:
+		return thinkContent(m.Text())
+	case ReasoningHidden, ReasoningNone:
+		return ""
+	}
+	return m.reasoning()
+}
+
+// thinks reports whether the model may spend part of its budget thinking before it answers
+func (p *ModelProfile) thinks() bool {
+	return p.Reasoning != ReasoningNone && (p.Reasoning != ReasoningAuto || p.ReasoningTokens > 0)
+}
+
+// applyTo adapts a request built for a plain chat model to what the model supports. maxTokens is the budget for the
+// answer, the reasoning budget is added on top.
+func (p *ModelProfile) applyTo(request *ChatRequest, maxTokens int) {
+	maxTokens += p.ReasoningTokens
+	if p.MaxCompletionTokens {
+		request.MaxTokens = 0
+		request.MaxCompletionTokens = maxTokens
+	} else {
+		request.MaxTokens = maxTokens
+	}
+
+	if p.NoTemperature {
+		request.Temperature = 0
+	}
+
+	if p.NoResponseFormat {
+		request.ResponseFormat = nil
+	}
+
+	if p.NoSystemMessages {
+		request.Messages = foldSystemMessages(request.Messages)
+	}
+}
+
+// foldSystemMessages turns system messages into user messages for models that don't accept them. a system prompt is
+// merged into the text message that follows it, so the conversation still starts with a single user message.
+func foldSystemMessages(messages []Message) []Message {
+	folded := make([]Message, 0, len(messages))
+	var pending []string
+	for _, m := range messages {
+		if m.Role == "system" {
+			pending = append(pending, m.Text())
+			continue
+		}
+		if len(pending) > 0 {
+			if text, ok := m.Content.(string); ok && m.Role == "user" {
+				m.Content = strings.Join(pending, "\n\n") + "\n\n" + text
+			} else {
+				folded = append(folded, Message{Role: "user", Content: strings.Join(pending, "\n\n")})
+			}
+			pending = nil
+		}
+		folded = append(folded, m)
+	}
+	if len(pending) > 0 {
+		folded = append(folded, Message{Role: "user", Content: strings.Join(pending, "\n\n")})
+	}
+	return folded
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter keeps a completions backend under its requests per minute, tokens per minute and in-flight limits. Calls
+// wait in a first-in first-out queue until there is capacity. A zero limit is not enforced.
+type RateLimiter struct {
+	backend     string
+	rpm         int
+	tpm         int
+	maxInFlight int
+
+	mu          sync.Mutex
+	queue       []*rateLimitTicket
+	requests    []time.Time
+	tokens      []*rateLimitTicket
+	inFlight    int
+	pausedUntil time.Time
+	// changed is closed and replaced whenever capacity might have freed up
+	changed chan struct{}
+}
+
+type rateLimitTicket struct {
+	at     time.Time
+	tokens int
+}
+
+func NewRateLimiter(backend string, rpm, tpm, maxInFlight int) *RateLimiter {
+	return &RateLimiter{
+		backend:     backend,
+		rpm:         rpm,
+		tpm:         tpm,
+		maxInFlight: maxInFlight,
+		changed:     make(chan struct{}),
+	}
+}
+
+func (rl *RateLimiter) notifyLocked() {
+	close(rl.changed)
+	rl.changed = make(chan struct{})
+}
+
+// Acquire blocks until the request can be sent. The returned release func must be called once the request finishes,
+// with the number of tokens it actually used if known (or zero to keep the estimate).
+func (rl *RateLimiter) Acquire(ctx context.Context, estimatedTokens int) (func(actualTokens int), error) {
+	start := time.Now()
+	ticket := &rateLimitTicket{tokens: estimatedTokens}
+
+	rl.mu.Lock()
+	rl.queue = append(rl.queue, ticket)
+	for {
+		now := time.Now()
+		wait := rl.waitLocked(ticket, now)
+		if wait == 0 {
+			break
+		}
+
+		changed := rl.changed
+		rl.mu.Unlock()
+
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			rl.mu.Lock()
+			rl.removeLocked(ticket)
+			rl.notifyLocked()
+			rl.mu.Unlock()
+			return nil, ctx.Err()
+		case <-changed:
+		case <-timer:
+		}
+
+		rl.mu.Lock()
+	}
+
+	rl.queue = rl.queue[1:]
+	ticket.at = time.Now()
+	rl.requests = append(rl.requests, ticket.at)
+	rl.tokens = append(rl.tokens, ticket)
+	rl.inFlight++
+	rl.notifyLocked()
+	rl.mu.Unlock()
+
+	rateLimitWait.WithLabelValues(rl.backend).Observe(time.Since(start).Seconds())
+	rateLimitInFlight.WithLabelValues(rl.backend).Inc()
+
+	var once sync.Once
+	return func(actualTokens int) {
+		once.Do(func() {
+			rl.mu.Lock()
+			if actualTokens > 0 {
+				ticket.tokens = actualTokens
+			}
+			rl.inFlight--
+			rl.notifyLocked()
+			rl.mu.Unlock()
+			rateLimitInFlight.WithLabelValues(rl.backend).Dec()
+		})
+	}, nil
+}
+
+// waitLocked returns zero when the ticket may go now, a positive duration when it should check again after that long,
+// and a negative duration when it has to wait for something else to change
+func (rl *RateLimiter) waitLocked(ticket *rateLimitTicket, now time.Time) time.Duration {
+	if rl.queue[0] != ticket {
+		return -1
+	}
+
+	if now.Before(rl.pausedUntil) {
+		return rl.pausedUntil.Sub(now)
+	}
+
+	if rl.maxInFlight > 0 && rl.inFlight >= rl.maxInFlight {
+		return -1
+	}
+
+	windowStart := now.Add(-time.Minute)
+	for len(rl.requests) > 0 && !rl.requests[0].After(windowStart) {
+		rl.requests = rl.requests[1:]
+	}
+	for len(rl.tokens) > 0 && !rl.tokens[0].at.After(windowStart) {
+		rl.tokens = rl.tokens[1:]
+	}
+
+	if rl.rpm > 0 && len(rl.requests) >= rl.rpm {
+		return rl.requests[0].Sub(windowStart)
+	}
+
+	if rl.tpm > 0 && len(rl.tokens) > 0 {
+		used := 0
+		for _, t := range rl.tokens {
+			used += t.tokens
+		}
+		// a single request bigger than the whole budget is let through once the window is empty
+		if used+ticket.tokens > rl.tpm {
+			return rl.tokens[0].at.Sub(windowStart)
+		}
+	}
+
+	return 0
+}
+
+func (rl *RateLimiter) removeLocked(ticket *rateLimitTicket) {
+	for i, t := range rl.queue {
+		if t == ticket {
+			rl.queue = append(rl.queue[:i], rl.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Pause stops any new requests from going out for the given duration, used when the server tells us to back off
+func (rl *RateLimiter) Pause(d time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if until.After(rl.pausedUntil) {
+		rl.pausedUntil = until
+		rl.notifyLocked()
+	}
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of seconds or an http date
+func parseRetryAfter(header http.Header) time.Duration {
+	val := header.Get("retry-after")
+	if val == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(val); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(val); err == nil {
+		return max(time.Until(t), 0)
+	}
+
+	return 0
+}
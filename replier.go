@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+// ReplierContext is what we know about the account that wrote a reply. Lookups that fail are left at their zero value
+// and the matching Known flag stays false.
+type ReplierContext struct {
+	RelationshipKnown bool
+	FollowsOp         bool
+	FollowedByOp      bool
+
+	ProfileKnown bool
+	CreatedAt    time.Time
+	PostsCount   int64
+
+	// PriorLabels counts the labels previously logged for the replier's replies, across every op. Labels a reviewer
+	// rejected, or that are still waiting for review, don't count
+	PriorLabels map[string]int
+}
+
+// AccountAge returns how old the account is, or zero if the profile couldn't be looked up
+func (r *ReplierContext) AccountAge() time.Duration {
+	if r == nil || !r.ProfileKnown || r.CreatedAt.IsZero() {
+		return 0
+	}
+	return time.Since(r.CreatedAt)
+}
+
+// buildReplierContext returns the replier context for the prompt, or nil if it isn't enabled
+func (dsmt *DontShowMeThis) buildReplierContext(ctx context.Context, opDid, replierDid string) *ReplierContext {
+	if !dsmt.replierContextEnabled {
+		return nil
+	}
+	return dsmt.lookupReplierContext(ctx, opDid, replierDid)
+}
+
+// lookupReplierContext looks up the replier's relationship to the op, their profile and their label history. Results
+// are cached per op and replier, since the same people tend to reply to each other over and over.
+func (dsmt *DontShowMeThis) lookupReplierContext(ctx context.Context, opDid, replierDid string) *ReplierContext {
+	cacheKey := opDid + " " + replierDid
+	if rc, ok := dsmt.replierCache.Get(cacheKey); ok {
+		return rc
+	}
+
+	logger := dsmt.logger.With("op", opDid, "replier", replierDid)
+	rc := &ReplierContext{}
+
+	if opDid != "" && opDid != replierDid {
+		resp, err := bsky.GraphGetRelationships(ctx, dsmt.xrpcc, opDid, []string{replierDid})
+		if err != nil {
+			logger.Warn("failed to get relationship to op", "error", err)
+		} else if resp != nil {
+			for _, rel := range resp.Relationships {
+				if rel.GraphDefs_Relationship == nil || rel.GraphDefs_Relationship.Did != replierDid {
+					continue
+				}
+				// the relationship is from the op's point of view
+				rc.RelationshipKnown = true
+				rc.FollowedByOp = rel.GraphDefs_Relationship.Following != nil
+				rc.FollowsOp = rel.GraphDefs_Relationship.FollowedBy != nil
+			}
+		}
+	}
+
+	profile, err := bsky.ActorGetProfile(ctx, dsmt.xrpcc, replierDid)
+	if err != nil {
+		logger.Warn("failed to get replier profile", "error", err)
+	} else if profile != nil {
+		rc.ProfileKnown = true
+		if profile.PostsCount != nil {
+			rc.PostsCount = *profile.PostsCount
+		}
+		if profile.CreatedAt != nil {
+			if t, err := time.Parse(time.RFC3339, *profile.CreatedAt); err == nil {
+				rc.CreatedAt = t
+			}
+		}
+	}
+
+	if dsmt.db != nil {
+		var rows []struct {
+			Label string
+			Count int
+		}
+		if err := dsmt.db.WithContext(ctx).Model(&LogItem{}).
+			Select("label, COUNT(*) AS count").
+			Where("author_did = ? AND label NOT IN ?", replierDid, []string{LabelNoLabels, LabelUnclassified}).
+			Where("NOT (reviewed AND NOT confirmed) AND NOT (needs_review AND NOT reviewed)").
+			Group("label").
+			Scan(&rows).Error; err != nil {
+			logger.Warn("failed to load replier label history", "error", err)
+		} else if len(rows) > 0 {
+			rc.PriorLabels = make(map[string]int, len(rows))
+			for _, row := range rows {
+				rc.PriorLabels[row.Label] = row.Count
+			}
+		}
+	}
+
+	// don't remember a total failure, the next reply can try again
+	if rc.RelationshipKnown || rc.ProfileKnown || rc.PriorLabels != nil {
+		dsmt.replierCache.Add(cacheKey, rc)
+	}
+
+	return rc
+}
+
+// Render describes the replier for the prompt. Ages and counts are bucketed so the wording, and so the classification
+// cache key, stays the same from one reply to the next. Returns an empty string if nothing is known.
+func (r *ReplierContext) Render() string {
+	if r == nil {
+		return ""
+	}
+
+	var lines []string
+
+	if r.RelationshipKnown {
+		switch {
+		case r.FollowsOp && r.FollowedByOp:
+			lines = append(lines, "- the replier and the original poster follow each other")
+		case r.FollowsOp:
+			lines = append(lines, "- the replier follows the original poster, but is not followed back")
+		case r.FollowedByOp:
+			lines = append(lines, "- the original poster follows the replier, but is not followed back")
+		default:
+			lines = append(lines, "- the replier and the original poster do not follow each other")
+		}
+	}
+
+	if r.ProfileKnown {
+		if age := r.AccountAge(); age > 0 {
+			lines = append(lines, "- the account is "+accountAgeBucket(age))
+		}
+		lines = append(lines, "- the account has "+postsCountBucket(r.PostsCount))
+	}
+
+	if len(r.PriorLabels) > 0 {
+		labels := make([]string, 0, len(r.PriorLabels))
+		for l := range r.PriorLabels {
+			labels = append(labels, l)
+		}
+		slices.Sort(labels)
+
+		counts := make([]string, len(labels))
+		for i, l := range labels {
+			counts[i] = fmt.Sprintf("%s %d times", l, r.PriorLabels[l])
+		}
+		lines = append(lines, "- earlier replies by this account were labeled "+strings.Join(counts, ", "))
+	}
+
+	if len(lines) == 0 {
+		return ""
+	}
+
+	return "[about the replier]\n" + strings.Join(lines, "\n") + "\n"
+}
+
+func accountAgeBucket(age time.Duration) string {
+	switch {
+	case age < 24*time.Hour:
+		return "less than a day old"
+	case age < 7*24*time.Hour:
+		return "less than a week old"
+	case age < 30*24*time.Hour:
+		return "less than a month old"
+	case age < 365*24*time.Hour:
+		return "less than a year old"
+	default:
+		return "more than a year old"
+	}
+}
+
+func postsCountBucket(count int64) string {
+	switch {
+	case count == 0:
+		return "no posts"
+	case count < 10:
+		return "fewer than 10 posts"
+	case count < 100:
+		return "fewer than 100 posts"
+	case count < 1000:
+		return "fewer than 1000 posts"
+	default:
+		return "1000 or more posts"
+	}
+}
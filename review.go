@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+var reviewCommand = &cli.Command{
+	Name:  "review",
+	Usage: "review logged labels. confirmed and rejected labels can be shown to the model as few shot examples",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "list",
+			Usage: "list logged labels that haven't been reviewed yet",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "disagreements",
+					Usage: "only list labels the classifiers disagreed on",
+				},
+				&cli.StringFlag{
+					Name:  "label",
+					Usage: "only list this label",
+				},
+				&cli.IntFlag{
+					Name:  "limit",
+					Usage: "most rows to list",
+					Value: 20,
+				},
+			},
+			Action: func(cmd *cli.Context) error {
+				db, err := openLogDb(cmd)
+				if err != nil {
+					return err
+				}
+
+				q := db.Where("reviewed = ? AND label != ?", false, LabelUnclassified)
+				if cmd.Bool("disagreements") {
+					q = q.Where("needs_review = ?", true)
+				}
+				if label := cmd.String("label"); label != "" {
+					q = q.Where("label = ?", label)
+				}
+
+				var items []LogItem
+				if err := q.Order("id DESC").Limit(cmd.Int("limit")).Find(&items).Error; err != nil {
+					return fmt.Errorf("failed to load log items: %w", err)
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "ID\tLABEL\tDISAGREED\tPARENT\tREPLY")
+				for _, item := range items {
+					fmt.Fprintf(w, "%d\t%s\t%t\t%s\t%s\n", item.ID, item.Label, item.NeedsReview, oneLine(item.ParentText, 60), oneLine(item.AuthorText, 60))
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:      "confirm",
+			Usage:     "mark logged labels as correct",
+			ArgsUsage: "<id>...",
+			Action: func(cmd *cli.Context) error {
+				return markReviewed(cmd, true)
+			},
+		},
+		{
+			Name:      "reject",
+			Usage:     "mark logged labels as wrong",
+			ArgsUsage: "<id>...",
+			Action: func(cmd *cli.Context) error {
+				return markReviewed(cmd, false)
+			},
+		},
+	},
+}
+
+func markReviewed(cmd *cli.Context, confirmed bool) error {
+	if cmd.NArg() == 0 {
+		return fmt.Errorf("no log item ids given")
+	}
+
+	ids := make([]uint, 0, cmd.NArg())
+	for _, arg := range cmd.Args().Slice() {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad log item id %q: %w", arg, err)
+		}
+		ids = append(ids, uint(id))
+	}
+
+	db, err := openLogDb(cmd)
+	if err != nil {
+		return err
+	}
+
+	res := db.Model(&LogItem{}).Where("id IN ?", ids).Updates(map[string]any{
+		"reviewed":  true,
+		"confirmed": confirmed,
+	})
+	if res.Error != nil {
+		return fmt.Errorf("failed to update log items: %w", res.Error)
+	}
+
+	fmt.Printf("marked %d of %d log items as reviewed\n", res.RowsAffected, len(ids))
+	return nil
+}
+
+// oneLine flattens text onto a single line and cuts it to n runes for table output
+func oneLine(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return text
+}
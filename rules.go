@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type RuleAction string
+
+const (
+	// emit the rule's label without asking the classifiers
+	RuleActionEmit RuleAction = "emit"
+	// drop the reply entirely
+	RuleActionSkip RuleAction = "skip"
+	// classify the reply, even when later rules would match or the budget has been spent
+	RuleActionClassify RuleAction = "classify"
+	// log the reply as unclassified without asking the classifiers
+	RuleActionLogOnly RuleAction = "log-only"
+)
+
+const (
+	ReplyTypeReply = "reply"
+	ReplyTypeQuote = "quote"
+)
+
+// Rule is a declarative check run before any classifier. Every condition that is set must match, and the first
+// matching rule in the file decides what happens to the reply.
+type Rule struct {
+	Name string `json:"name"`
+
+	TextRegex     string   `json:"text_regex,omitempty"`
+	LinkDomains   []string `json:"link_domains,omitempty"`
+	AuthorDids    []string `json:"author_dids,omitempty"`
+	ReplyType     string   `json:"reply_type,omitempty"`
+	Langs         []string `json:"langs,omitempty"`
+	MinAccountAge string   `json:"min_account_age,omitempty"`
+	MaxAccountAge string   `json:"max_account_age,omitempty"`
+	// match on whether the replier follows, or is followed by, the op. nil matches either way
+	FollowsOp    *bool  `json:"follows_op,omitempty"`
+	FollowedByOp *bool  `json:"followed_by_op,omitempty"`
+	MinPosts     *int64 `json:"min_posts,omitempty"`
+	MaxPosts     *int64 `json:"max_posts,omitempty"`
+	// match repliers whose earlier replies were labeled at least this many times, e.g. {"bad-faith": 3}
+	MinPriorLabels map[string]int `json:"min_prior_labels,omitempty"`
+	// match replies the injection detector flagged
+	PromptInjection bool `json:"prompt_injection,omitempty"`
+
+	Action RuleAction `json:"action"`
+	Label  string     `json:"label,omitempty"`
+
+	textRegex     *regexp.Regexp
+	minAccountAge time.Duration
+	maxAccountAge time.Duration
+}
+
+type RulesConfig struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// RuleSubject is the reply being checked. Replier is only called when a rule needs it, since it costs a lookup.
+type RuleSubject struct {
+	Text      string
+	Domains   []string
+	AuthorDid string
+	ReplyType string
+	Langs     []string
+	Injection bool
+	Replier   func() *ReplierContext
+}
+
+// RuleHit is a record of a rule deciding what happened to a reply
+type RuleHit struct {
+	gorm.Model
+	Rule      string `gorm:"index"`
+	Action    string
+	Label     string
+	AuthorDid string `gorm:"index"`
+	AuthorUri string
+	ParentUri string
+}
+
+func LoadRules(path string) (*RulesConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	var config RulesConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %w", err)
+	}
+
+	for i, r := range config.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+
+		switch r.Action {
+		case RuleActionEmit:
+			if !slices.Contains(AllLabels, r.Label) {
+				return nil, fmt.Errorf("rule %s emits unknown label %q", r.Name, r.Label)
+			}
+		case RuleActionSkip, RuleActionClassify, RuleActionLogOnly:
+		default:
+			return nil, fmt.Errorf("rule %s has unknown action %q", r.Name, r.Action)
+		}
+
+		if r.ReplyType != "" && r.ReplyType != ReplyTypeReply && r.ReplyType != ReplyTypeQuote {
+			return nil, fmt.Errorf("rule %s has a bad reply type. must be either \"reply\" or \"quote\"", r.Name)
+		}
+
+		if r.TextRegex != "" {
+			r.textRegex, err = regexp.Compile(r.TextRegex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s has a bad text regex: %w", r.Name, err)
+			}
+		}
+
+		if r.MinAccountAge != "" {
+			r.minAccountAge, err = time.ParseDuration(r.MinAccountAge)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s has a bad min account age: %w", r.Name, err)
+			}
+		}
+		if r.MaxAccountAge != "" {
+			r.maxAccountAge, err = time.ParseDuration(r.MaxAccountAge)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s has a bad max account age: %w", r.Name, err)
+			}
+		}
+
+		if r.MinPosts != nil && *r.MinPosts < 0 || r.MaxPosts != nil && *r.MaxPosts < 0 {
+			return nil, fmt.Errorf("rule %s has a negative post count", r.Name)
+		}
+
+		for label, count := range r.MinPriorLabels {
+			if !slices.Contains(AllLabels, label) {
+				return nil, fmt.Errorf("rule %s counts unknown prior label %q", r.Name, label)
+			}
+			if count < 1 {
+				return nil, fmt.Errorf("rule %s must count at least one prior %s label", r.Name, label)
+			}
+		}
+
+		for j, d := range r.LinkDomains {
+			r.LinkDomains[j] = strings.TrimPrefix(strings.ToLower(d), "www.")
+		}
+
+		if r.textRegex == nil && len(r.LinkDomains) == 0 && len(r.AuthorDids) == 0 && r.ReplyType == "" && len(r.Langs) == 0 && !r.PromptInjection && !r.usesReplier() {
+			return nil, fmt.Errorf("rule %s has no conditions", r.Name)
+		}
+	}
+
+	return &config, nil
+}
+
+// Match returns the first rule that matches the subject, or nil if none do
+func (c *RulesConfig) Match(s *RuleSubject) *Rule {
+	if c == nil {
+		return nil
+	}
+	for _, r := range c.Rules {
+		if r.matches(s) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *Rule) usesAccountAge() bool {
+	return r.minAccountAge > 0 || r.maxAccountAge > 0
+}
+
+// usesReplier reports whether the rule has conditions on the replier context
+func (r *Rule) usesReplier() bool {
+	return r.usesAccountAge() || r.FollowsOp != nil || r.FollowedByOp != nil || r.MinPosts != nil || r.MaxPosts != nil || len(r.MinPriorLabels) > 0
+}
+
+func (r *Rule) matches(s *RuleSubject) bool {
+	if len(r.AuthorDids) > 0 && !slices.Contains(r.AuthorDids, s.AuthorDid) {
+		return false
+	}
+
+	if r.ReplyType != "" && r.ReplyType != s.ReplyType {
+		return false
+	}
+
+	if len(r.Langs) > 0 && !slices.ContainsFunc(s.Langs, func(lang string) bool {
+		return slices.ContainsFunc(r.Langs, func(want string) bool { return langMatches(lang, want) })
+	}) {
+		return false
+	}
+
+	if len(r.LinkDomains) > 0 && !slices.ContainsFunc(s.Domains, func(domain string) bool {
+		return slices.ContainsFunc(r.LinkDomains, func(want string) bool { return domainMatches(domain, want) })
+	}) {
+		return false
+	}
+
+	if r.PromptInjection && !s.Injection {
+		return false
+	}
+
+	if r.textRegex != nil && !r.textRegex.MatchString(s.Text) {
+		return false
+	}
+
+	// checked last, they're the only conditions that need a network lookup
+	if r.usesReplier() {
+		if s.Replier == nil {
+			return false
+		}
+		return r.matchesReplier(s.Replier())
+	}
+
+	return true
+}
+
+// matchesReplier checks the conditions on the replier. A condition on something that couldn't be looked up doesn't match
+func (r *Rule) matchesReplier(rc *ReplierContext) bool {
+	if rc == nil {
+		return false
+	}
+
+	if r.usesAccountAge() {
+		age := rc.AccountAge()
+		if age == 0 {
+			return false
+		}
+		if r.minAccountAge > 0 && age < r.minAccountAge {
+			return false
+		}
+		if r.maxAccountAge > 0 && age > r.maxAccountAge {
+			return false
+		}
+	}
+
+	if r.FollowsOp != nil || r.FollowedByOp != nil {
+		if !rc.RelationshipKnown {
+			return false
+		}
+		if r.FollowsOp != nil && *r.FollowsOp != rc.FollowsOp {
+			return false
+		}
+		if r.FollowedByOp != nil && *r.FollowedByOp != rc.FollowedByOp {
+			return false
+		}
+	}
+
+	if r.MinPosts != nil || r.MaxPosts != nil {
+		if !rc.ProfileKnown {
+			return false
+		}
+		if r.MinPosts != nil && rc.PostsCount < *r.MinPosts {
+			return false
+		}
+		if r.MaxPosts != nil && rc.PostsCount > *r.MaxPosts {
+			return false
+		}
+	}
+
+	for label, count := range r.MinPriorLabels {
+		if rc.PriorLabels[label] < count {
+			return false
+		}
+	}
+
+	return true
+}
+
+// langMatches reports whether a post language matches a wanted one, so "en" matches "en-US"
+func langMatches(lang, want string) bool {
+	lang, want = strings.ToLower(lang), strings.ToLower(want)
+	return lang == want || strings.HasPrefix(lang, want+"-")
+}
+
+// domainMatches reports whether a domain is the wanted one or a subdomain of it
+func domainMatches(domain, want string) bool {
+	domain = strings.ToLower(domain)
+	return domain == want || strings.HasSuffix(domain, "."+want)
+}
+
+func (dsmt *DontShowMeThis) recordRuleHit(ctx context.Context, rule *Rule, authorDid, uri, parentUri string) error {
+	ruleHits.WithLabelValues(rule.Name, string(rule.Action)).Inc()
+
+	if dsmt.db == nil {
+		return nil
+	}
+
+	hit := RuleHit{
+		Rule:      rule.Name,
+		Action:    string(rule.Action),
+		Label:     rule.Label,
+		AuthorDid: authorDid,
+		AuthorUri: uri,
+		ParentUri: parentUri,
+	}
+	return dsmt.db.WithContext(ctx).Create(&hit).Error
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadRule parses a single rule the way LoadRules does, so its regex and durations are compiled
+func loadRule(t *testing.T, rule string) *Rule {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(`{"rules": [`+rule+`]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("LoadRules: %v", err)
+	}
+	return config.Rules[0]
+}
+
+func TestRuleMatches(t *testing.T) {
+	replier := &ReplierContext{
+		RelationshipKnown: true,
+		FollowsOp:         true,
+		ProfileKnown:      true,
+		CreatedAt:         time.Now().Add(-48 * time.Hour),
+		PostsCount:        12,
+		PriorLabels:       map[string]int{LabelBadFaith: 3},
+	}
+
+	subject := &RuleSubject{
+		Text:      "check out https://www.spam.example/deal",
+		Domains:   []string{"www.spam.example"},
+		AuthorDid: "did:plc:author",
+		ReplyType: ReplyTypeQuote,
+		Langs:     []string{"en-US"},
+		Replier:   func() *ReplierContext { return replier },
+	}
+
+	tests := []struct {
+		name string
+		rule string
+		want bool
+	}{
+		{"text regex", `{"text_regex": "(?i)CHECK OUT", "action": "skip"}`, true},
+		{"text regex miss", `{"text_regex": "nothing", "action": "skip"}`, false},
+		{"subdomain of link domain", `{"link_domains": ["spam.example"], "action": "skip"}`, true},
+		{"other link domain", `{"link_domains": ["example.com"], "action": "skip"}`, false},
+		{"author did", `{"author_dids": ["did:plc:author"], "action": "skip"}`, true},
+		{"reply type", `{"reply_type": "reply", "action": "skip"}`, false},
+		{"language prefix", `{"langs": ["en"], "action": "skip"}`, true},
+		{"other language", `{"langs": ["ja"], "action": "skip"}`, false},
+		{"prompt injection", `{"prompt_injection": true, "action": "skip"}`, false},
+		{"max account age", `{"max_account_age": "72h", "action": "skip"}`, true},
+		{"min account age", `{"min_account_age": "72h", "action": "skip"}`, false},
+		{"follows op", `{"follows_op": true, "action": "skip"}`, true},
+		{"mutuals", `{"follows_op": true, "followed_by_op": true, "action": "skip"}`, false},
+		{"not followed by op", `{"followed_by_op": false, "action": "skip"}`, true},
+		{"post count in range", `{"min_posts": 10, "max_posts": 100, "action": "skip"}`, true},
+		{"too few posts", `{"min_posts": 100, "action": "skip"}`, false},
+		{"prior labels reached", `{"min_prior_labels": {"bad-faith": 3}, "action": "skip"}`, true},
+		{"prior labels not reached", `{"min_prior_labels": {"bad-faith": 4}, "action": "skip"}`, false},
+		{"prior labels never seen", `{"min_prior_labels": {"off-topic": 1}, "action": "skip"}`, false},
+		{"every condition must match", `{"author_dids": ["did:plc:author"], "langs": ["ja"], "action": "skip"}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := loadRule(t, tt.rule).matches(subject); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleMatchesUnknownReplier(t *testing.T) {
+	subject := &RuleSubject{
+		Replier: func() *ReplierContext { return &ReplierContext{} },
+	}
+
+	// a condition on something that couldn't be looked up never matches, even when it asks for false
+	for _, rule := range []string{
+		`{"followed_by_op": false, "action": "skip"}`,
+		`{"max_posts": 10, "action": "skip"}`,
+		`{"max_account_age": "72h", "action": "skip"}`,
+	} {
+		if loadRule(t, rule).matches(subject) {
+			t.Errorf("%s matched a replier that couldn't be looked up", rule)
+		}
+	}
+
+	if loadRule(t, `{"follows_op": true, "action": "skip"}`).matches(&RuleSubject{}) {
+		t.Error("a replier condition matched without a replier lookup")
+	}
+}
+
+func TestRuleReplierLookedUpLast(t *testing.T) {
+	looked := false
+	subject := &RuleSubject{
+		AuthorDid: "did:plc:other",
+		Replier: func() *ReplierContext {
+			looked = true
+			return &ReplierContext{}
+		},
+	}
+
+	rule := loadRule(t, `{"author_dids": ["did:plc:author"], "follows_op": true, "action": "skip"}`)
+	if rule.matches(subject) {
+		t.Fatal("rule matched another author")
+	}
+	if looked {
+		t.Error("replier was looked up although a cheaper condition already failed")
+	}
+}
+
+func TestLoadRulesRejectsBadRules(t *testing.T) {
+	for _, rule := range []string{
+		`{"action": "skip"}`,
+		`{"text_regex": "x", "action": "label"}`,
+		`{"text_regex": "x", "action": "emit", "label": "nope"}`,
+		`{"reply_type": "repost", "action": "skip"}`,
+		`{"min_posts": -1, "action": "skip"}`,
+		`{"min_prior_labels": {"nope": 1}, "action": "skip"}`,
+		`{"min_prior_labels": {"bad-faith": 0}, "action": "skip"}`,
+	} {
+		b, _ := json.Marshal(map[string]any{"rules": []json.RawMessage{json.RawMessage(rule)}})
+		path := filepath.Join(t.TempDir(), "rules.json")
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRules(path); err == nil {
+			t.Errorf("LoadRules accepted %s", rule)
+		}
+	}
+}
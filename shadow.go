@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+// ShadowLabel is a label that would have been emitted if the op weren't in shadow mode
+type ShadowLabel struct {
+	gorm.Model
+	OpDid     string `gorm:"index"`
+	AuthorDid string `gorm:"index"`
+	Uri       string `gorm:"index"`
+	ParentUri string
+	Label     string `gorm:"index"`
+	// Backend is the comma separated list of backends that decided the label, or the rule that did
+	Backend string
+	// PromotedAt is set once the label has been queued for the labeler by shadow promote
+	PromotedAt *time.Time `gorm:"index"`
+}
+
+// isShadowOp reports whether labels for replies to the op should be recorded instead of emitted
+func (dsmt *DontShowMeThis) isShadowOp(opDid string) bool {
+	if _, ok := dsmt.shadowOps[opDid]; ok {
+		return true
+	}
+	_, isWatchedOp := dsmt.watchedOps[opDid]
+	return dsmt.shadow && isWatchedOp
+}
+
+func (dsmt *DontShowMeThis) recordShadowLabels(opDid, authorDid, uri, parentUri string, decision *Decision) error {
+	if len(decision.Emit) == 0 {
+		return nil
+	}
+
+	backend := strings.Join(decision.Backends, ",")
+	rows := make([]ShadowLabel, len(decision.Emit))
+	for i, l := range decision.Emit {
+		rows[i] = ShadowLabel{
+			OpDid:     opDid,
+			AuthorDid: authorDid,
+			Uri:       uri,
+			ParentUri: parentUri,
+			Label:     l,
+			Backend:   backend,
+		}
+		shadowLabels.WithLabelValues(l).Inc()
+	}
+
+	return dsmt.db.Create(&rows).Error
+}
+
+type ShadowRow struct {
+	Key     string
+	Labels  map[string]int
+	Total   int
+	Replies map[string]struct{}
+}
+
+// ShadowReport counts the labels shadow mode held back since the given time by op, by reply author and by day. A
+// reply counts once towards Replies however many labels it would have had.
+func ShadowReport(db *gorm.DB, since time.Time, opDid string) (byOp, byAuthor, byDay []*ShadowRow, err error) {
+	q := db.Where("created_at >= ?", since)
+	if opDid != "" {
+		q = q.Where("op_did = ?", opDid)
+	}
+
+	var labels []ShadowLabel
+	if err := q.Order("created_at").Find(&labels).Error; err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to load shadow labels: %w", err)
+	}
+
+	add := func(rows []*ShadowRow, idx map[string]int, key string, l ShadowLabel) []*ShadowRow {
+		i, ok := idx[key]
+		if !ok {
+			i = len(rows)
+			idx[key] = i
+			rows = append(rows, &ShadowRow{Key: key, Labels: map[string]int{}, Replies: map[string]struct{}{}})
+		}
+		rows[i].Labels[l.Label]++
+		rows[i].Total++
+		rows[i].Replies[l.Uri] = struct{}{}
+		return rows
+	}
+
+	opIdx := map[string]int{}
+	authorIdx := map[string]int{}
+	dayIdx := map[string]int{}
+	for _, l := range labels {
+		op := l.OpDid
+		if op == "" {
+			op = "(account labels)"
+		}
+		byOp = add(byOp, opIdx, op, l)
+		byAuthor = add(byAuthor, authorIdx, l.AuthorDid, l)
+		byDay = add(byDay, dayIdx, l.CreatedAt.UTC().Format(time.DateOnly), l)
+	}
+
+	// the authors who would have been labeled most come first
+	sort.SliceStable(byAuthor, func(i, j int) bool { return byAuthor[i].Total > byAuthor[j].Total })
+
+	return byOp, byAuthor, byDay, nil
+}
+
+var shadowCommand = &cli.Command{
+	Name:  "shadow",
+	Usage: "report on and promote labels held back by shadow mode",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "report",
+			Usage: "print what would have been labeled, by op, reply author and day",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "since",
+					Usage: "how far back to report",
+					Value: 7 * 24 * time.Hour,
+				},
+				&cli.StringFlag{
+					Name:  "op",
+					Usage: "only report on replies to this op",
+				},
+				&cli.IntFlag{
+					Name:  "top-authors",
+					Usage: "how many reply authors to list",
+					Value: 20,
+				},
+			},
+			Action: func(cmd *cli.Context) error {
+				db, err := openLogDb(cmd)
+				if err != nil {
+					return err
+				}
+
+				byOp, byAuthor, byDay, err := ShadowReport(db, time.Now().Add(-cmd.Duration("since")), cmd.String("op"))
+				if err != nil {
+					return err
+				}
+				if n := cmd.Int("top-authors"); len(byAuthor) > n {
+					byAuthor = byAuthor[:n]
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				for _, section := range []struct {
+					title string
+					rows  []*ShadowRow
+				}{
+					{"OP", byOp},
+					{"AUTHOR", byAuthor},
+					{"DAY", byDay},
+				} {
+					fmt.Fprintf(w, "%s\tREPLIES\tLABELS", section.title)
+					for _, l := range AllLabels {
+						fmt.Fprintf(w, "\t%s", strings.ToUpper(l))
+					}
+					fmt.Fprintln(w)
+					for _, r := range section.rows {
+						fmt.Fprintf(w, "%s\t%d\t%d", r.Key, len(r.Replies), r.Total)
+						for _, l := range AllLabels {
+							fmt.Fprintf(w, "\t%d", r.Labels[l])
+						}
+						fmt.Fprintln(w)
+					}
+					fmt.Fprintln(w)
+				}
+
+				return w.Flush()
+			},
+		},
+		{
+			Name:  "promote",
+			Usage: "queue an op's recent shadow labels for the labeler, after moving it from SHADOW_OPS to WATCHED_OPS",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "op",
+					Usage:    "the op whose shadow labels to emit",
+					Required: true,
+				},
+				&cli.DurationFlag{
+					Name:  "since",
+					Usage: "only emit labels recorded this recently",
+					Value: 24 * time.Hour,
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "list the labels that would be emitted without queueing anything",
+				},
+			},
+			Action: func(cmd *cli.Context) error {
+				db, err := openLogDb(cmd)
+				if err != nil {
+					return err
+				}
+				db.AutoMigrate(&OutboxEntry{}, &LabelNegation{})
+
+				ttls, err := ParseLabelTtls(cmd.StringSlice("label-ttls"))
+				if err != nil {
+					return err
+				}
+
+				var labels []ShadowLabel
+				// labels negated since they were recorded were wrong, and stay held back
+				if err := db.Where("op_did = ? AND created_at >= ? AND promoted_at IS NULL", cmd.String("op"), time.Now().Add(-cmd.Duration("since"))).
+					Where("NOT EXISTS (SELECT 1 FROM label_negations n WHERE n.uri = shadow_labels.uri AND n.label = shadow_labels.label AND n.deleted_at IS NULL)").
+					Order("id").
+					Find(&labels).Error; err != nil {
+					return fmt.Errorf("failed to load shadow labels: %w", err)
+				}
+
+				// labels keep the exp they would have had if they had been emitted when recorded, and ones that would
+				// have expired by now are left out
+				now := time.Now()
+				labels = slices.DeleteFunc(labels, func(l ShadowLabel) bool {
+					exp := ttls.Exp(l.Label, l.CreatedAt)
+					return exp != nil && exp.Before(now)
+				})
+
+				if cmd.Bool("dry-run") {
+					for _, l := range labels {
+						fmt.Printf("%s\t%s\n", l.Label, l.Uri)
+					}
+					fmt.Printf("would emit %d labels\n", len(labels))
+					return nil
+				}
+
+				if err := db.Transaction(func(tx *gorm.DB) error {
+					for _, l := range labels {
+						if err := enqueueLabel(tx, l.Uri, l.Label, false, ttls.Exp(l.Label, l.CreatedAt)); err != nil {
+							return err
+						}
+						if err := tx.Model(&ShadowLabel{}).Where("id = ?", l.ID).Update("promoted_at", now).Error; err != nil {
+							return fmt.Errorf("failed to mark shadow label as promoted: %w", err)
+						}
+					}
+					return nil
+				}); err != nil {
+					return err
+				}
+
+				fmt.Printf("queued %d labels, the running consumer will emit them\n", len(labels))
+				return nil
+			},
+		},
+	},
+}
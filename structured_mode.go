@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StructuredOutputMode is how the model is made to answer in JSON
+type StructuredOutputMode string
+
+const (
+	// probe the server once and use the best mode it supports
+	StructuredOutputAuto StructuredOutputMode = "auto"
+	// response_format json_schema with strict set
+	StructuredOutputJSONSchema StructuredOutputMode = "json_schema"
+	// response_format json_object, the schema is only described in the prompt
+	StructuredOutputJSONObject StructuredOutputMode = "json_object"
+	// a forced call to a function whose arguments are the answer
+	StructuredOutputTools StructuredOutputMode = "tools"
+	// nothing beyond the prompt, the answer is pulled out of whatever the model says
+	StructuredOutputNone StructuredOutputMode = "none"
+)
+
+// the order modes are probed in, from the strictest to the loosest
+var structuredOutputProbeOrder = []StructuredOutputMode{
+	StructuredOutputJSONSchema,
+	StructuredOutputJSONObject,
+	StructuredOutputTools,
+}
+
+func ParseStructuredOutputMode(s string) (StructuredOutputMode, error) {
+	switch mode := StructuredOutputMode(s); mode {
+	case StructuredOutputAuto, StructuredOutputJSONSchema, StructuredOutputJSONObject, StructuredOutputTools, StructuredOutputNone:
+		return mode, nil
+	case "":
+		return StructuredOutputJSONSchema, nil
+	}
+	return "", fmt.Errorf("unknown structured output mode %q", s)
+}
+
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  *ResponseSchema `json:"parameters,omitempty"`
+	// Arguments is only set on calls made by the model, as a JSON encoded string
+	Arguments string `json:"arguments,omitempty"`
+}
+
+type ToolCall struct {
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// setStructuredOutput asks for an answer in the schema using the given mode
+func (r *ChatRequest) setStructuredOutput(mode StructuredOutputMode, name string, schema ResponseSchema) {
+	r.ResponseFormat = nil
+	r.Tools = nil
+	r.ToolChoice = nil
+
+	switch mode {
+	case StructuredOutputJSONSchema:
+		r.ResponseFormat = &ResponseFormat{
+			Type: "json_schema",
+			JSONSchema: &JSONSchemaWrap{
+				Name:   name,
+				Schema: schema,
+				Strict: true,
+			},
+		}
+	case StructuredOutputJSONObject:
+		r.ResponseFormat = &ResponseFormat{Type: "json_object"}
+	case StructuredOutputTools:
+		r.Tools = []Tool{{
+			Type: "function",
+			Function: ToolFunction{
+				Name:        name,
+				Description: "Record the answer.",
+				Parameters:  &schema,
+			},
+		}}
+		r.ToolChoice = map[string]any{
+			"type":     "function",
+			"function": map[string]string{"name": name},
+		}
+	}
+}
+
+// answerText is the text holding the model's answer, which is the arguments of its tool call when it made one
+func answerText(m Message) string {
+	for _, call := range m.ToolCalls {
+		if call.Function.Arguments != "" {
+			return call.Function.Arguments
+		}
+	}
+	return m.Text()
+}
+
+// how long probing every mode may take. requests wait for the probe, so a server that hangs mustn't hold them forever
+const structuredOutputProbeTimeout = 30 * time.Second
+
+var probeSchema = ResponseSchema{
+	Type: "object",
+	Properties: map[string]Property{
+		"ok": {
+			Type:        "boolean",
+			Description: "Always true.",
+		},
+	},
+	Required: []string{"ok"},
+}
+
+// structuredOutputMode is the configured mode, or the one found by probing the server when set to auto. a probe that
+// fails for any reason other than the server rejecting every mode, e.g. it couldn't be reached or the api key is
+// wrong, is tried again on the next request.
+func (c *LMStudioClient) structuredOutputMode(ctx context.Context) StructuredOutputMode {
+	if c.outputMode != StructuredOutputAuto {
+		return c.outputMode
+	}
+
+	c.probeMu.Lock()
+	defer c.probeMu.Unlock()
+
+	if c.probedMode != "" {
+		return c.probedMode
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, structuredOutputProbeTimeout)
+	defer cancel()
+
+	mode, err := c.probeStructuredOutput(ctx)
+	if err != nil {
+		c.logger.Warn("failed to probe structured output support, using json_schema until the next probe", "error", err)
+		return StructuredOutputJSONSchema
+	}
+
+	c.logger.Info("detected structured output mode", "mode", mode)
+	c.probedMode = mode
+	return mode
+}
+
+// probeStructuredOutput asks the server for a trivial answer in each mode, strictest first, and returns the first mode
+// that comes back valid. servers that reject a mode with a 400 or 422, or accept it but ignore it, move on to the next
+// one. any other error ends the probe, since it says nothing about which modes are supported.
+func (c *LMStudioClient) probeStructuredOutput(ctx context.Context) (StructuredOutputMode, error) {
+	for _, mode := range structuredOutputProbeOrder {
+		request := ChatRequest{
+			Model: c.currentModel(),
+			Messages: []Message{
+				{
+					Role:    "system",
+					Content: "Always respond with pure JSON. The structure should be {ok: boolean}.",
+				},
+				{
+					Role:    "user",
+					Content: "Respond with ok set to true.",
+				},
+			},
+		}
+		request.setStructuredOutput(mode, "probe", probeSchema)
+		c.currentProfile().applyTo(&request, 20)
+
+		response, err := c.sendChatRequest(ctx, request)
+		if err != nil {
+			if !isRequestRejected(err) || ctx.Err() != nil {
+				return "", err
+			}
+			c.logger.Info("server rejected structured output mode", "mode", mode, "error", err)
+			continue
+		}
+
+		msg := response.Choices[0].Message
+		if mode == StructuredOutputTools && len(msg.ToolCalls) == 0 {
+			c.logger.Info("server ignored structured output mode", "mode", mode)
+			continue
+		}
+		if _, err := parseStructuredOutput(answerText(msg), probeSchema); err != nil {
+			c.logger.Info("server ignored structured output mode", "mode", mode, "error", err)
+			continue
+		}
+
+		return mode, nil
+	}
+
+	return StructuredOutputNone, nil
+}
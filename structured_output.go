@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ClassificationError wraps a failure from a completions backend and records whether trying again could help. When
+// the server said how long to wait before trying again, RetryAfter is set.
+type ClassificationError struct {
+	Err        error
+	Retryable  bool
+	RetryAfter time.Duration
+	// StatusCode is the http status the server answered with, 0 when the request never got an answer
+	StatusCode int
+}
+
+func (e *ClassificationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ClassificationError) Unwrap() error {
+	return e.Err
+}
+
+func retryableError(err error) error {
+	return &ClassificationError{Err: err, Retryable: true}
+}
+
+func permanentError(err error) error {
+	return &ClassificationError{Err: err, Retryable: false}
+}
+
+// IsRetryable reports whether err was marked retryable. Errors that were never classified are treated as permanent.
+func IsRetryable(err error) bool {
+	var cerr *ClassificationError
+	if errors.As(err, &cerr) {
+		return cerr.Retryable
+	}
+	return false
+}
+
+// isRequestRejected reports whether the server answered that something in the request body was invalid, as opposed to
+// failing for a reason that has nothing to do with what was asked, like a bad api key or an unknown model
+func isRequestRejected(err error) bool {
+	var cerr *ClassificationError
+	if errors.As(err, &cerr) {
+		return cerr.StatusCode == http.StatusBadRequest || cerr.StatusCode == http.StatusUnprocessableEntity
+	}
+	return false
+}
+
+// isPermanent reports whether err was explicitly marked as permanent. Unlike !IsRetryable, errors that were never
+// classified don't count.
+func isPermanent(err error) bool {
+	var cerr *ClassificationError
+	if errors.As(err, &cerr) {
+		return !cerr.Retryable
+	}
+	return false
+}
+
+// ValidationError means the model answered, but not with something that matches the schema. These are fed back to the
+// model so it can correct itself.
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid structured output: " + e.Reason
+}
+
+var thinkBlockRegex = regexp.MustCompile(`(?s)<think>(.*?)</think>`)
+
+// thinkContent returns the text inside any think blocks
+func thinkContent(content string) string {
+	var parts []string
+	for _, m := range thinkBlockRegex.FindAllStringSubmatch(content, -1) {
+		if t := strings.TrimSpace(m[1]); t != "" {
+			parts = append(parts, t)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// extractJSON pulls the first JSON object out of a model response, ignoring <think> blocks, markdown fences and any
+// prose around the object
+func extractJSON(content string) (string, error) {
+	content = thinkBlockRegex.ReplaceAllString(content, "")
+	// some servers strip the opening tag but leave the closing one behind
+	if _, after, ok := strings.Cut(content, "</think>"); ok {
+		content = after
+	}
+	// an unterminated think block means the model ran out of tokens before answering
+	if before, _, ok := strings.Cut(content, "<think>"); ok {
+		content = before
+	}
+
+	start := strings.IndexByte(content, '{')
+	if start == -1 {
+		return "", &ValidationError{Reason: "response did not contain a JSON object"}
+	}
+
+	depth := 0
+	inString := false
+	escaped := false
+	for i := start; i < len(content); i++ {
+		ch := content[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch ch {
+		case '"':
+			inString = true
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return content[start : i+1], nil
+			}
+		}
+	}
+
+	return "", &ValidationError{Reason: "JSON object in response was not terminated"}
+}
+
+// validateAgainstSchema checks a decoded object against one of our response schemas. Only the small subset of JSON
+// schema that we actually use is supported.
+func validateAgainstSchema(obj map[string]any, schema ResponseSchema) error {
+	return validateObject("", obj, schema.Properties, schema.Required)
+}
+
+func validateObject(path string, obj map[string]any, properties map[string]Property, required []string) error {
+	for _, key := range required {
+		if _, ok := obj[key]; !ok {
+			return &ValidationError{Reason: fmt.Sprintf("missing required field %q", path+key)}
+		}
+	}
+
+	for key, val := range obj {
+		prop, ok := properties[key]
+		if !ok {
+			return &ValidationError{Reason: fmt.Sprintf("unexpected field %q", path+key)}
+		}
+		if err := validateProperty(path+key, val, prop); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateProperty(key string, val any, prop Property) error {
+	var ok bool
+	switch prop.Type {
+	case "boolean":
+		_, ok = val.(bool)
+	case "string":
+		var s string
+		s, ok = val.(string)
+		if ok && len(prop.Enum) > 0 && !slices.Contains(prop.Enum, s) {
+			return &ValidationError{Reason: fmt.Sprintf("field %q must be one of %s", key, strings.Join(prop.Enum, ", "))}
+		}
+	case "number":
+		_, ok = val.(float64)
+	case "integer":
+		var f float64
+		f, ok = val.(float64)
+		ok = ok && f == math.Trunc(f)
+	case "array":
+		var arr []any
+		arr, ok = val.([]any)
+		if ok && prop.Items != nil {
+			for i, item := range arr {
+				if err := validateProperty(fmt.Sprintf("%s[%d]", key, i), item, *prop.Items); err != nil {
+					return err
+				}
+			}
+		}
+	case "object":
+		var obj map[string]any
+		obj, ok = val.(map[string]any)
+		if ok && prop.Properties != nil {
+			if err := validateObject(key+".", obj, prop.Properties, prop.Required); err != nil {
+				return err
+			}
+		}
+	default:
+		ok = true
+	}
+
+	if !ok {
+		return &ValidationError{Reason: fmt.Sprintf("field %q must be of type %s", key, prop.Type)}
+	}
+
+	return nil
+}
+
+// parseStructuredOutput extracts and validates a model response against the given schema
+func parseStructuredOutput(content string, schema ResponseSchema) (map[string]any, error) {
+	rawJson, err := extractJSON(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(rawJson), &obj); err != nil {
+		return nil, &ValidationError{Reason: fmt.Sprintf("response was not valid JSON: %s", err)}
+	}
+
+	if err := validateAgainstSchema(obj, schema); err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+type ThreadRole string
+
+const (
+	ThreadRoleOp      ThreadRole = "original poster"
+	ThreadRoleReplier ThreadRole = "replier"
+	ThreadRoleOther   ThreadRole = "someone else"
+)
+
+// ThreadEntry is a post above the parent in the thread being replied to
+type ThreadEntry struct {
+	Role    ThreadRole
+	Handle  string
+	Content PostContent
+}
+
+// buildAncestry walks up the thread from the parent towards the root, stopping at the configured depth or once the
+// token budget is used up. Cached records are used where possible, and the rest of the thread is fetched with a single
+// getPostThread call. The returned entries are ordered oldest first.
+func (dsmt *DontShowMeThis) buildAncestry(ctx context.Context, parent *bsky.FeedPost, opDid, replierDid string) []ThreadEntry {
+	if dsmt.threadContextDepth <= 0 || parent.Reply == nil || parent.Reply.Parent == nil {
+		return nil
+	}
+
+	roleFor := func(did string) ThreadRole {
+		switch did {
+		case opDid:
+			return ThreadRoleOp
+		case replierDid:
+			return ThreadRoleReplier
+		}
+		return ThreadRoleOther
+	}
+
+	// collected nearest first, reversed at the end
+	var entries []ThreadEntry
+	tokens := 0
+	add := func(did, handle string, post *bsky.FeedPost) bool {
+		content := dsmt.buildPostContent(ctx, post)
+		cost := len(content.Render()) / 4
+		if dsmt.threadContextTokens > 0 && tokens+cost > dsmt.threadContextTokens {
+			return false
+		}
+		tokens += cost
+		if handle == "" {
+			handle = dsmt.resolveHandle(ctx, did)
+		} else {
+			handle = "@" + handle
+		}
+		entries = append(entries, ThreadEntry{
+			Role:    roleFor(did),
+			Handle:  handle,
+			Content: content,
+		})
+		return true
+	}
+
+	cur := parent
+	for len(entries) < dsmt.threadContextDepth && cur.Reply != nil && cur.Reply.Parent != nil {
+		uri := cur.Reply.Parent.Uri
+
+		if post, ok := dsmt.postCache.Get(uri); ok {
+			atUri, err := syntax.ParseATURI(uri)
+			if err != nil {
+				break
+			}
+			if !add(atUri.Authority().String(), "", post) {
+				break
+			}
+			cur = post
+			continue
+		}
+
+		remaining := dsmt.threadContextDepth - len(entries)
+		dsmt.fetchAncestors(ctx, uri, remaining, add)
+		break
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	return entries
+}
+
+// fetchAncestors gets uri and up to height-1 of its parents with getPostThread, handing each to add nearest first
+// until add returns false. Fetched records are cached for the next reply in the same thread.
+func (dsmt *DontShowMeThis) fetchAncestors(ctx context.Context, uri string, height int, add func(did, handle string, post *bsky.FeedPost) bool) {
+	resp, err := bsky.FeedGetPostThread(ctx, dsmt.xrpcc, 0, int64(height-1), uri)
+	if err != nil {
+		dsmt.logger.Warn("failed to get thread for context", "uri", uri, "error", err)
+		return
+	}
+
+	if resp == nil || resp.Thread == nil {
+		return
+	}
+
+	tvp := resp.Thread.FeedDefs_ThreadViewPost
+	for tvp != nil && tvp.Post != nil && tvp.Post.Record != nil {
+		post, ok := tvp.Post.Record.Val.(*bsky.FeedPost)
+		if !ok {
+			return
+		}
+		dsmt.postCache.Add(tvp.Post.Uri, post)
+
+		var did, handle string
+		if tvp.Post.Author != nil {
+			did = tvp.Post.Author.Did
+			handle = tvp.Post.Author.Handle
+		}
+		if !add(did, handle, post) {
+			return
+		}
+
+		if tvp.Parent == nil {
+			return
+		}
+		tvp = tvp.Parent.FeedDefs_ThreadViewPost
+	}
+}
+
+// renderAncestry formats the thread as a transcript for the prompt, or an empty string if there is none
+func renderAncestry(entries []ThreadEntry) string {
+	if len(entries) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("[earlier posts in the thread, oldest first]\n")
+	for i, e := range entries {
+		fmt.Fprintf(&sb, "\n%d. (%s %s)\n%s\n", i+1, e.Role, e.Handle, wrapUntrusted("post", e.Content.Render()))
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+type BudgetAction string
+
+const (
+	// stop classifying and only log replies once over budget
+	BudgetActionLogOnly BudgetAction = "log-only"
+	// keep classifying, but with the cheaper fallback model
+	BudgetActionFallback BudgetAction = "fallback"
+)
+
+// Usage is the token accounting returned by the completions api. OpenAI style apis use prompt/completion tokens, while
+// Anthropic style apis use input/output tokens.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens,omitempty"`
+	CompletionTokens int `json:"completion_tokens,omitempty"`
+	TotalTokens      int `json:"total_tokens,omitempty"`
+	InputTokens      int `json:"input_tokens,omitempty"`
+	OutputTokens     int `json:"output_tokens,omitempty"`
+}
+
+func (u *Usage) Prompt() int {
+	return max(u.PromptTokens, u.InputTokens)
+}
+
+func (u *Usage) Completion() int {
+	return max(u.CompletionTokens, u.OutputTokens)
+}
+
+func (u *Usage) Total() int {
+	return max(u.TotalTokens, u.Prompt()+u.Completion())
+}
+
+// ModelPrice is in USD per million tokens
+type ModelPrice struct {
+	Input  float64
+	Output float64
+}
+
+// ParseModelPricing reads entries in the form model=input:output, with prices in USD per million tokens
+func ParseModelPricing(entries []string) (map[string]ModelPrice, error) {
+	pricing := make(map[string]ModelPrice, len(entries))
+	for _, e := range entries {
+		model, prices, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad model pricing %q, must be model=input:output", e)
+		}
+		in, out, ok := strings.Cut(prices, ":")
+		if !ok {
+			return nil, fmt.Errorf("bad model pricing %q, must be model=input:output", e)
+		}
+		inPrice, err := strconv.ParseFloat(in, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad input price in %q: %w", e, err)
+		}
+		outPrice, err := strconv.ParseFloat(out, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad output price in %q: %w", e, err)
+		}
+		pricing[model] = ModelPrice{Input: inPrice, Output: outPrice}
+	}
+	return pricing, nil
+}
+
+type usageAttributionKey struct{}
+
+type usageAttribution struct {
+	OpDid string
+	Uri   string
+}
+
+// withUsageAttribution tags a context so completions requests made with it are recorded against the op and reply
+func withUsageAttribution(ctx context.Context, opDid, uri string) context.Context {
+	return context.WithValue(ctx, usageAttributionKey{}, usageAttribution{OpDid: opDid, Uri: uri})
+}
+
+func usageAttributionFrom(ctx context.Context) usageAttribution {
+	attr, _ := ctx.Value(usageAttributionKey{}).(usageAttribution)
+	return attr
+}
+
+// UsageTracker records the tokens and cost of every completions request, and keeps running day and month totals so
+// budget caps can be enforced
+type UsageTracker struct {
+	db            *gorm.DB
+	logger        *slog.Logger
+	pricing       map[string]ModelPrice
+	dailyBudget   float64
+	monthlyBudget float64
+	action        BudgetAction
+
+	mu         sync.Mutex
+	day        string
+	daySpend   float64
+	month      string
+	monthSpend float64
+}
+
+func NewUsageTracker(db *gorm.DB, pricing map[string]ModelPrice, dailyBudget, monthlyBudget float64, action BudgetAction, logger *slog.Logger) (*UsageTracker, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	switch action {
+	case BudgetActionLogOnly, BudgetActionFallback:
+	default:
+		return nil, fmt.Errorf("unknown budget action %q", action)
+	}
+
+	t := &UsageTracker{
+		db:            db,
+		logger:        logger.With("component", "usage"),
+		pricing:       pricing,
+		dailyBudget:   dailyBudget,
+		monthlyBudget: monthlyBudget,
+		action:        action,
+	}
+
+	now := time.Now().UTC()
+	t.day = now.Format(time.DateOnly)
+	t.month = now.Format("2006-01")
+
+	if db != nil {
+		dayStart := now.Truncate(24 * time.Hour)
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+		if err := db.Model(&UsageRecord{}).Where("created_at >= ?", dayStart).Select("COALESCE(SUM(cost), 0)").Scan(&t.daySpend).Error; err != nil {
+			return nil, fmt.Errorf("failed to load daily spend: %w", err)
+		}
+		if err := db.Model(&UsageRecord{}).Where("created_at >= ?", monthStart).Select("COALESCE(SUM(cost), 0)").Scan(&t.monthSpend).Error; err != nil {
+			return nil, fmt.Errorf("failed to load monthly spend: %w", err)
+		}
+	}
+
+	spendGauge.WithLabelValues("day").Set(t.daySpend)
+	spendGauge.WithLabelValues("month").Set(t.monthSpend)
+
+	return t, nil
+}
+
+func (t *UsageTracker) rollLocked(now time.Time) {
+	now = now.UTC()
+	if day := now.Format(time.DateOnly); day != t.day {
+		t.day = day
+		t.daySpend = 0
+	}
+	if month := now.Format("2006-01"); month != t.month {
+		t.month = month
+		t.monthSpend = 0
+	}
+}
+
+// Record stores the usage for a single request and returns its cost
+func (t *UsageTracker) Record(ctx context.Context, backend, model string, usage *Usage) float64 {
+	if usage == nil {
+		return 0
+	}
+
+	price := t.pricing[model]
+	cost := float64(usage.Prompt())*price.Input/1_000_000 + float64(usage.Completion())*price.Output/1_000_000
+
+	completionsTokens.WithLabelValues(backend, "prompt").Add(float64(usage.Prompt()))
+	completionsTokens.WithLabelValues(backend, "completion").Add(float64(usage.Completion()))
+	completionsCost.WithLabelValues(backend).Add(cost)
+
+	t.mu.Lock()
+	t.rollLocked(time.Now())
+	wasOver := t.overBudgetLocked()
+	t.daySpend += cost
+	t.monthSpend += cost
+	isOver := t.overBudgetLocked()
+	daySpend, monthSpend := t.daySpend, t.monthSpend
+	t.mu.Unlock()
+
+	spendGauge.WithLabelValues("day").Set(daySpend)
+	spendGauge.WithLabelValues("month").Set(monthSpend)
+
+	if isOver && !wasOver {
+		t.logger.Warn("budget reached", "action", t.action, "daySpend", daySpend, "monthSpend", monthSpend)
+	}
+
+	if t.db == nil {
+		return cost
+	}
+
+	attr := usageAttributionFrom(ctx)
+	record := UsageRecord{
+		Backend:          backend,
+		ModelName:        model,
+		OpDid:            attr.OpDid,
+		AuthorUri:        attr.Uri,
+		PromptTokens:     usage.Prompt(),
+		CompletionTokens: usage.Completion(),
+		Cost:             cost,
+	}
+
+	if err := t.db.Create(&record).Error; err != nil {
+		t.logger.Error("failed to record usage", "error", err)
+	}
+
+	return cost
+}
+
+// AttributeLabels marks the usage rows for a reply with the labels it ended up getting, so spend can be split by label
+func (t *UsageTracker) AttributeLabels(ctx context.Context, uri string, labels []string) {
+	if t.db == nil || uri == "" || len(labels) == 0 {
+		return
+	}
+
+	if err := t.db.WithContext(ctx).Model(&UsageRecord{}).Where("author_uri = ?", uri).Update("labels", strings.Join(labels, ",")).Error; err != nil {
+		t.logger.Error("failed to attribute labels to usage", "error", err)
+	}
+}
+
+func (t *UsageTracker) overBudgetLocked() bool {
+	return (t.dailyBudget > 0 && t.daySpend >= t.dailyBudget) || (t.monthlyBudget > 0 && t.monthSpend >= t.monthlyBudget)
+}
+
+func (t *UsageTracker) OverBudget() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollLocked(time.Now())
+	return t.overBudgetLocked()
+}
+
+// LogOnly reports whether classification should be skipped entirely because the budget has been spent
+func (t *UsageTracker) LogOnly() bool {
+	return t.action == BudgetActionLogOnly && t.OverBudget()
+}
+
+// UseFallback reports whether backends with a budget fallback model should switch to it
+func (t *UsageTracker) UseFallback() bool {
+	return t.action == BudgetActionFallback && t.OverBudget()
+}
+
+type SpendRow struct {
+	Key              string
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+}
+
+// SpendReport groups spend since the given time by day, op and label. Rows with several labels count towards each.
+func SpendReport(db *gorm.DB, since time.Time) (byDay, byOp, byLabel []SpendRow, err error) {
+	var records []UsageRecord
+	if err := db.Where("created_at >= ?", since).Order("created_at").Find(&records).Error; err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to load usage: %w", err)
+	}
+
+	add := func(rows []SpendRow, idx map[string]int, key string, r UsageRecord) []SpendRow {
+		i, ok := idx[key]
+		if !ok {
+			i = len(rows)
+			idx[key] = i
+			rows = append(rows, SpendRow{Key: key})
+		}
+		rows[i].Requests++
+		rows[i].PromptTokens += r.PromptTokens
+		rows[i].CompletionTokens += r.CompletionTokens
+		rows[i].Cost += r.Cost
+		return rows
+	}
+
+	dayIdx := map[string]int{}
+	opIdx := map[string]int{}
+	labelIdx := map[string]int{}
+	for _, r := range records {
+		byDay = add(byDay, dayIdx, r.CreatedAt.UTC().Format(time.DateOnly), r)
+
+		op := r.OpDid
+		if op == "" {
+			op = "(unattributed)"
+		}
+		byOp = add(byOp, opIdx, op, r)
+
+		if r.Labels == "" {
+			byLabel = add(byLabel, labelIdx, LabelNoLabels, r)
+			continue
+		}
+		for _, l := range strings.Split(r.Labels, ",") {
+			byLabel = add(byLabel, labelIdx, l, r)
+		}
+	}
+
+	return byDay, byOp, byLabel, nil
+}
+
+var spendCommand = &cli.Command{
+	Name:  "spend",
+	Usage: "print completions api spend by day, watched op and label",
+	Flags: []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "since",
+			Usage: "how far back to report",
+			Value: 30 * 24 * time.Hour,
+		},
+	},
+	Action: func(cmd *cli.Context) error {
+		db, err := openLogDb(cmd)
+		if err != nil {
+			return err
+		}
+
+		byDay, byOp, byLabel, err := SpendReport(db, time.Now().Add(-cmd.Duration("since")))
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, section := range []struct {
+			title string
+			rows  []SpendRow
+		}{
+			{"DAY", byDay},
+			{"OP", byOp},
+			{"LABEL", byLabel},
+		} {
+			fmt.Fprintf(w, "%s\tREQUESTS\tPROMPT TOKENS\tCOMPLETION TOKENS\tCOST (USD)\n", section.title)
+			for _, r := range section.rows {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.4f\n", r.Key, r.Requests, r.PromptTokens, r.CompletionTokens, r.Cost)
+			}
+			fmt.Fprintln(w)
+		}
+
+		return w.Flush()
+	},
+}